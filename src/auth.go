@@ -1,6 +1,7 @@
 package main
 
 import (
+	"load-balancer/src/server"
 	"net/http"
 	"net/url"
 	"strings"
@@ -20,9 +21,13 @@ func auth(next http.HandlerFunc)  http.HandlerFunc{
 			return
 		}
 	
+		var priority server.Priority
+		var apiKey string
+
 		// Check if the API key is in the query parameters
-		if apiKey, ok := queryParams["key"]; ok {
-			if apiKey[0] != API_KEY {
+		if keys, ok := queryParams["key"]; ok {
+			apiKey = keys[0]
+			if priority, ok = apiKeys[apiKey]; !ok {
 				http.Error(w, "Invalid API key", http.StatusUnauthorized)
 				return
 			}
@@ -38,35 +43,37 @@ func auth(next http.HandlerFunc)  http.HandlerFunc{
 				return
 			}
 
-			if authKey[1] != API_KEY {
+			var ok bool
+			apiKey = authKey[1]
+			if priority, ok = apiKeys[apiKey]; !ok {
 				http.Error(w, "Invalid API key", http.StatusUnauthorized)
 				return
 			}
 		}
+
+		// The priority header can only lower the priority granted by the API key
+		if priorityHeader := r.Header.Get(server.PRIORITY_HEADER); priorityHeader != "" {
+			requested, err := server.ParsePriority(priorityHeader)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if requested < priority {
+				priority = requested
+			}
+			r.Header.Del(server.PRIORITY_HEADER)
+		}
 	
+		// The key is only logged through its id
+		ctx := server.WithAPIKeyID(server.WithPriority(r.Context(), priority), server.APIKeyID(apiKey))
+
 		// Call the next handler
-		next(w, r)
+		next(w, r.WithContext(ctx))
 	}
 
 }
 
+// authAdmin checks the admin API key of the request (see server.AdminAuth)
 func authAdmin(next http.HandlerFunc) http.HandlerFunc {
-	// API key can be set in the headers "X-API-KEY"
-	return func(w http.ResponseWriter, r *http.Request) {
-		
-		// Check if the API key is in the headers
-		authKey := strings.Split(r.Header.Get("Authorization"), " ")
-		if len(authKey) != 2 || authKey[0] != "Bearer" {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-
-		if authKey[1] != ADMIN_API_KEY {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-	
-		// Call the next handler
-		next(w, r)
-	}
-}
\ No newline at end of file
+	return server.AdminAuth(ADMIN_API_KEY, next)
+}
@@ -2,10 +2,19 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"load-balancer/src/prometheus"
 	"load-balancer/src/server"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"time"
 
@@ -15,10 +24,47 @@ import (
 )
 
 var (
+	command string
+	commandArgs []string
+
+	serverStore string
 	postgresURL string
+	secretsKey []byte
+	serversFile string
+	dnsConfig server.DNSConfig
 	API_KEY string
 	ADMIN_API_KEY string
 	serveAsProxy bool
+
+	// API keys accepted by the balancer, and the highest priority each of them may use
+	apiKeys map[string]server.Priority
+
+	// Admission control (requests served concurrently, requests waiting for a slot and how long they may wait)
+	maxConcurrentRequests int = 512
+	maxQueuedRequests int = 1024
+	queueTimeout time.Duration = 5 * time.Second
+
+	// Export of the traces to an OpenTelemetry collector (disabled without endpoint)
+	tracingConfig server.TracingConfig
+
+	// Buckets of the latency histograms, and of the balancer overhead histogram (seconds)
+	latencyBuckets []float64
+	overheadBuckets []float64
+
+	// Access log of the proxied requests (stdout, file or off)
+	accessLogConfig server.AccessLogConfig
+
+	// Address, timeouts and TLS of the HTTP server
+	listenConfig server.ListenConfig
+
+	// Connection pool, timeouts and HTTP/2 of the connections to the nodes
+	transportConfig = server.DefaultTransportConfig()
+
+	// Graceful shutdown (delay between failing the readiness probe and draining, and how long in-flight requests may take to complete)
+	shutdownDelay time.Duration = 5 * time.Second
+	shutdownTimeout time.Duration = 30 * time.Second
+	// How long the pending spans may take to be exported, once the requests have been drained
+	tracingShutdownTimeout time.Duration = 5 * time.Second
 )
 
 func init() {
@@ -29,6 +75,7 @@ func init() {
 		devMode := args[0] == "dev"
 		if devMode {
 			envFile = ".env.development"
+			args = args[1:]
 		} else {
 			envFile = ".env"
 		}
@@ -36,6 +83,16 @@ func init() {
 		envFile = ".env"
 	}
 
+	// Subcommand (eg "migrate"), the load balancer is started when there is none
+	if len(args) > 0 {
+		command = args[0]
+		commandArgs = args[1:]
+
+		if command != "migrate" {
+			log.Fatalf("Unknown command: %s. Must be 'migrate' (or none to start the load balancer)", command)
+		}
+	}
+
 	log.Printf("Loading environment variables from %s\n", envFile)
 	
 	// Load environment variables from .env file
@@ -44,12 +101,59 @@ func init() {
 		log.Fatalf("Failed to load .env file: %v", err)
 	}
 
+	// Servers are stored in Postgres by default, or in a JSON/YAML file for local and small setups
+	serverStore = os.Getenv("SERVER_STORE")
+	if serverStore == "" {
+		serverStore = "postgres"
+	}
+	if serverStore != "postgres" && serverStore != "file" && serverStore != "dns" {
+		log.Fatalf("Invalid value for SERVER_STORE: %s. Must be 'postgres', 'file' or 'dns'", serverStore)
+	}
+
 	postgresURL = os.Getenv("POSTGRES_URL")
 
-	if postgresURL == "" {
+	// The migrate command only needs the database
+	if command == "migrate" {
+		if postgresURL == "" {
+			log.Fatalln("POSTGRES_URL environment variable is required")
+		}
+		return
+	}
+
+	if serverStore == "postgres" && postgresURL == "" {
 		log.Fatalln("POSTGRES_URL environment variable is required")
 	}
 
+	// Encrypts the credentials of the servers in the database (32 bytes, base64 encoded: openssl rand -base64 32)
+	if secretsKeyStr := os.Getenv("SERVER_SECRETS_KEY"); secretsKeyStr != "" {
+		key, err := base64.StdEncoding.DecodeString(secretsKeyStr)
+		if err != nil || len(key) != 32 {
+			log.Fatalln("Invalid value for SERVER_SECRETS_KEY. Must be 32 bytes, base64 encoded")
+		}
+		secretsKey = key
+	}
+
+	serversFile = os.Getenv("SERVERS_FILE")
+	if serversFile == "" {
+		serversFile = "servers.json"
+	}
+
+	// Discovery of the servers from DNS records (SRV weight = rate limit, or the default profile)
+	dnsConfig = server.DNSConfig{
+		Name:              os.Getenv("DNS_NAME"),
+		Record:            os.Getenv("DNS_RECORD"),
+		Server:            os.Getenv("DNS_SERVER"),
+		Scheme:            os.Getenv("DNS_SCHEME"),
+		Port:              intFromEnv("DNS_PORT", 80),
+		RefreshInterval:   time.Duration(intFromEnv("DNS_REFRESH_SECONDS", 30)) * time.Second,
+		DefaultRateLimit:  intFromEnv("DNS_DEFAULT_RATE_LIMIT", 10),
+		DefaultBurstLimit: intFromEnv("DNS_DEFAULT_BURST_LIMIT", 10),
+	}
+
+	if serverStore == "dns" && dnsConfig.Name == "" {
+		log.Fatalln("DNS_NAME environment variable is required")
+	}
+
 	API_KEY = os.Getenv("API_KEY")
 	ADMIN_API_KEY = os.Getenv("ADMIN_API_KEY")
 
@@ -69,18 +173,209 @@ func init() {
 	serveAsProxy = serveAsProxyStr == "proxy"
 
 	log.Printf("Using %s mode\n", serveAsProxyStr)
+
+	// API_KEY is the public key (normal priority), PRIORITY_API_KEYS adds keys with their own priority, eg "key1:high,key2:low"
+	apiKeys = map[string]server.Priority{API_KEY: server.PriorityNormal}
+
+	if priorityKeys := os.Getenv("PRIORITY_API_KEYS"); priorityKeys != "" {
+		for _, entry := range strings.Split(priorityKeys, ",") {
+			key, priorityStr, found := strings.Cut(strings.TrimSpace(entry), ":")
+			if !found || key == "" {
+				log.Fatalf("Invalid PRIORITY_API_KEYS entry: %q. Must be 'key:priority'", entry)
+			}
+
+			priority, err := server.ParsePriority(priorityStr)
+			if err != nil {
+				log.Fatalf("Invalid PRIORITY_API_KEYS entry: %v", err)
+			}
+			apiKeys[key] = priority
+		}
+	}
+
+	maxConcurrentRequests = intFromEnv("MAX_CONCURRENT_REQUESTS", maxConcurrentRequests)
+	maxQueuedRequests = intFromEnv("MAX_QUEUED_REQUESTS", maxQueuedRequests)
+	server.MAX_REQUEST_BODY_BYTES = int64(intFromEnv("MAX_REQUEST_BODY_BYTES", int(server.MAX_REQUEST_BODY_BYTES)))
+	queueTimeout = time.Duration(intFromEnv("QUEUE_TIMEOUT_MS", int(queueTimeout.Milliseconds()))) * time.Millisecond
+
+	tracingConfig = server.TracingConfig{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		SampleRatio: ratioFromEnv("TRACING_SAMPLE_RATIO", 1),
+	}
+	if tracingConfig.ServiceName == "" {
+		tracingConfig.ServiceName = "load-balancer"
+	}
+
+	// JSON-RPC methods labelling the metrics, besides the methods of the Solana API
+	prometheus.AddMethodLabels(os.Getenv("METRICS_METHODS"))
+
+	latencyBuckets = bucketsFromEnv("LATENCY_BUCKETS", prometheus.DEFAULT_LATENCY_BUCKETS)
+	overheadBuckets = bucketsFromEnv("OVERHEAD_BUCKETS", prometheus.DEFAULT_OVERHEAD_BUCKETS)
+
+	accessLogConfig = server.AccessLogConfig{
+		Output:      os.Getenv("ACCESS_LOG"),
+		File:        os.Getenv("ACCESS_LOG_FILE"),
+		MaxSize:     int64(intFromEnv("ACCESS_LOG_MAX_SIZE_MB", 100)) << 20,
+		MaxBackups:  intFromEnv("ACCESS_LOG_MAX_BACKUPS", 5),
+		SampleRatio: ratioFromEnv("ACCESS_LOG_SAMPLE_RATIO", 1),
+		// The client address is read from X-Real-IP only behind these proxies (eg nginx)
+		TrustedProxies: prefixesFromEnv("TRUSTED_PROXIES"),
+	}
+	if accessLogConfig.Output == "" {
+		accessLogConfig.Output = "stdout"
+	}
+	if accessLogConfig.Output != "stdout" && accessLogConfig.Output != "file" && accessLogConfig.Output != "off" {
+		log.Fatalf("Invalid value for ACCESS_LOG: %s. Must be 'stdout', 'file' or 'off'", accessLogConfig.Output)
+	}
+	if accessLogConfig.File == "" {
+		accessLogConfig.File = "access.log"
+	}
+
+	// The timeouts protect against slow clients (slowloris), the write timeout must leave time for the slowest requests to the nodes
+	listenConfig = server.ListenConfig{
+		Addr:              os.Getenv("LISTEN_ADDR"),
+		ReadTimeout:       time.Duration(intFromEnv("READ_TIMEOUT_SECONDS", 60)) * time.Second,
+		ReadHeaderTimeout: time.Duration(intFromEnv("READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second,
+		WriteTimeout:      time.Duration(intFromEnv("WRITE_TIMEOUT_SECONDS", 60)) * time.Second,
+		IdleTimeout:       time.Duration(intFromEnv("IDLE_TIMEOUT_SECONDS", 120)) * time.Second,
+		MaxHeaderBytes:    intFromEnv("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+		TLSCertFile:       os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:        os.Getenv("TLS_KEY_FILE"),
+		HTTP2:             boolFromEnv("HTTP2", true),
+		H2C:               boolFromEnv("H2C", false),
+	}
+	if listenConfig.Addr == "" {
+		listenConfig.Addr = ":8000"
+	}
+	if (listenConfig.TLSCertFile == "") != (listenConfig.TLSKeyFile == "") {
+		log.Fatalln("TLS_CERT_FILE and TLS_KEY_FILE environment variables must be set together")
+	}
+
+	transportConfig.MaxIdleConns = intFromEnv("UPSTREAM_MAX_IDLE_CONNS", transportConfig.MaxIdleConns)
+	transportConfig.MaxConns = intFromEnv("UPSTREAM_MAX_CONNS", transportConfig.MaxConns)
+	transportConfig.IdleConnTimeout = time.Duration(intFromEnv("UPSTREAM_IDLE_CONN_TIMEOUT_SECONDS", int(transportConfig.IdleConnTimeout.Seconds()))) * time.Second
+	transportConfig.KeepAlive = time.Duration(intFromEnv("UPSTREAM_KEEP_ALIVE_SECONDS", int(transportConfig.KeepAlive.Seconds()))) * time.Second
+	transportConfig.DialTimeout = time.Duration(intFromEnv("UPSTREAM_DIAL_TIMEOUT_SECONDS", int(transportConfig.DialTimeout.Seconds()))) * time.Second
+	transportConfig.TLSHandshakeTimeout = time.Duration(intFromEnv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT_SECONDS", int(transportConfig.TLSHandshakeTimeout.Seconds()))) * time.Second
+	transportConfig.ResponseHeaderTimeout = time.Duration(intFromEnv("UPSTREAM_RESPONSE_HEADER_TIMEOUT_SECONDS", int(transportConfig.ResponseHeaderTimeout.Seconds()))) * time.Second
+	transportConfig.HTTP2 = boolFromEnv("UPSTREAM_HTTP2", transportConfig.HTTP2)
+
+	shutdownDelay = time.Duration(intFromEnv("SHUTDOWN_DELAY_SECONDS", int(shutdownDelay.Seconds()))) * time.Second
+	shutdownTimeout = time.Duration(intFromEnv("SHUTDOWN_TIMEOUT_SECONDS", int(shutdownTimeout.Seconds()))) * time.Second
 }
 
+// intFromEnv reads a positive integer from the environment, falling back to def if unset
+func intFromEnv(name string, def int) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return def
+	}
+
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value <= 0 {
+		log.Fatalf("Invalid value for %s: %s. Must be a positive integer", name, valueStr)
+	}
+	return value
+}
+
+// boolFromEnv reads a boolean (true or false) from the environment, falling back to def if unset
+func boolFromEnv(name string, def bool) bool {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return def
+	}
+
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %s. Must be 'true' or 'false'", name, valueStr)
+	}
+	return value
+}
+
+// ratioFromEnv reads a number between 0 and 1 from the environment, falling back to def if unset
+func ratioFromEnv(name string, def float64) float64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return def
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || value < 0 || value > 1 {
+		log.Fatalf("Invalid value for %s: %s. Must be between 0 and 1", name, valueStr)
+	}
+	return value
+}
+
+// bucketsFromEnv reads histogram buckets from the environment (increasing positive numbers of seconds, separated by commas), falling back to def if unset
+func bucketsFromEnv(name string, def []float64) []float64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return def
+	}
+
+	var buckets []float64
+	for _, bucketStr := range strings.Split(valueStr, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(bucketStr), 64)
+		if err != nil || bucket <= 0 || (len(buckets) > 0 && bucket <= buckets[len(buckets)-1]) {
+			log.Fatalf("Invalid value for %s: %s. Must be increasing positive numbers of seconds, separated by commas", name, valueStr)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// prefixesFromEnv reads IP addresses or CIDR ranges from the environment, separated by commas (none if unset)
+func prefixesFromEnv(name string) []netip.Prefix {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, prefixStr := range strings.Split(valueStr, ",") {
+		prefixStr = strings.TrimSpace(prefixStr)
+		prefix, err := netip.ParsePrefix(prefixStr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(prefixStr)
+			if addrErr != nil {
+				log.Fatalf("Invalid value for %s: %s. Must be IP addresses or CIDR ranges, separated by commas", name, valueStr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
 
 // Main application code
 func main() {
+	if command == "migrate" {
+		runMigrate(commandArgs)
+		return
+	}
+
 	config := server.Config{
+		Store:       serverStore,
 		PostgresURL: postgresURL,
+		SecretsKey:  secretsKey,
+		ServersFile: serversFile,
+		DNS:         dnsConfig,
+		Transport:   transportConfig,
 		// RedisURL:    os.Getenv("REDIS_URL"),
 		CacheSize:   100,                    // Cache up to 100 servers
 		CacheTTL:    15 * time.Minute,       // Cache TTL of 15 minutes
 	}
 
+	prometheus.RegisterHistograms(latencyBuckets, overheadBuckets)
+
+	shutdownTracing, err := server.SetupTracing(context.Background(), tracingConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	if tracingConfig.Endpoint != "" {
+		log.Printf("Exporting traces to %s\n", tracingConfig.Endpoint)
+	}
+
 	serverManager, err := server.NewServerManager(config)
 	if err != nil {
 		log.Fatalf("Failed to create server manager: %v", err)
@@ -90,6 +385,13 @@ func main() {
 	balancer := &server.Balancer{
 		ServerManager: serverManager,
 		ReverseProxy: serveAsProxy,
+		Admission: server.NewAdmission(maxConcurrentRequests, maxQueuedRequests, queueTimeout),
+	}
+
+	if accessLogConfig.Output != "off" {
+		if balancer.AccessLog, err = server.NewAccessLogger(accessLogConfig); err != nil {
+			log.Fatalf("Failed to create access log: %v", err)
+		}
 	}
 
 	// Create a new mux server (handles panic recovery and auth)
@@ -107,17 +409,100 @@ func main() {
 	// Add an endpoint to get server stats
 	mux.HandleAuthAdminFunc("/stats", balancer.HandleStats)
 
-	srv := &http.Server{
-		Addr:    ":8000",
-		Handler: mux,
-		// ReadTimeout:    15 * time.Second,
-        // WriteTimeout:   15 * time.Second,
-        // IdleTimeout:    60 * time.Second,
-        // MaxHeaderBytes: 1 << 20,
+	// Admin endpoints to manage the servers at runtime (changes are applied right away)
+	mux.HandleAuthAdminFunc("GET /admin/servers", balancer.HandleListServers)
+	mux.HandleAuthAdminFunc("POST /admin/servers", balancer.HandleCreateServer)
+	mux.HandleAuthAdminFunc("PATCH /admin/servers/{id}", balancer.HandleUpdateServer)
+	mux.HandleAuthAdminFunc("DELETE /admin/servers/{id}", balancer.HandleDeleteServer)
+	mux.HandleAuthAdminFunc("POST /admin/servers/{id}/drain", balancer.HandleDrainServer)
+	mux.HandleAuthAdminFunc("POST /admin/servers/{id}/undrain", balancer.HandleUndrainServer)
+	mux.HandleAuthAdminFunc("POST /admin/servers/{id}/enable", balancer.HandleEnableServer)
+	mux.HandleAuthAdminFunc("POST /admin/servers/{id}/disable", balancer.HandleDisableServer)
+	mux.HandleAuthAdminFunc("GET /admin/servers/{id}/events", balancer.HandleServerEvents)
+	mux.HandleAuthAdminFunc("GET /admin/sla", balancer.HandleSLAReport)
+
+	// Status dashboard (the browser asks for the admin API key as the password)
+	mux.HandleAuthAdminFunc("GET /admin/ui", balancer.HandleUI)
+	mux.HandleAuthAdminFunc("GET /admin/ui/", balancer.HandleUI)
+
+	// Readiness probe (no auth), fails as soon as the load balancer is shutting down
+	var ready atomic.Bool
+	ready.Store(true)
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+
+	srv, certificates, err := server.NewHTTPServer(listenConfig, mux)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
 	}
 
-	log.Println("Load Balancer listening on :8000")
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed to start: %v", err)
+	// The certificate is reloaded on SIGHUP (eg after a renewal)
+	stopReload := make(chan struct{})
+	defer close(stopReload)
+	if certificates != nil {
+		go certificates.ReloadOnSIGHUP(stopReload)
 	}
+
+	// Stop on SIGTERM (deploys) or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if listenConfig.TLS() {
+			log.Printf("Load Balancer listening on %s (TLS)\n", listenConfig.Addr)
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		log.Printf("Load Balancer listening on %s\n", listenConfig.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Fail the readiness probe first, and give some time to the proxies/orchestrator to stop sending new requests
+	log.Printf("Shutting down, waiting %v before draining connections\n", shutdownDelay)
+	ready.Store(false)
+	time.Sleep(shutdownDelay)
+
+	// Stop accepting new connections, and wait for the in-flight requests to complete
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("In-flight requests did not complete within %v: %v\n", shutdownTimeout, err)
+	}
+
+	// Stop the background routines (health check, cache refresh) and close the database connections
+	if err := serverManager.Close(); err != nil {
+		log.Printf("Error closing server manager: %v\n", err)
+	}
+
+	if balancer.AccessLog != nil {
+		if err := balancer.AccessLog.Close(); err != nil {
+			log.Printf("Error closing access log: %v\n", err)
+		}
+	}
+
+	// Export the spans still pending, with a timeout of its own: draining the requests may have used all of shutdownCtx
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancelTracing()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		log.Printf("Error flushing traces: %v\n", err)
+	}
+
+	log.Println("Load Balancer stopped")
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"load-balancer/src/server"
+	"log"
+	"os"
+)
+
+// runMigrate applies the pending migrations of the database schema (the load balancer also applies them when it starts), or lists them with -dry-run
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the pending migrations and their SQL without applying them")
+	flags.Parse(args)
+
+	migrations, err := server.Migrate(context.Background(), postgresURL, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+
+	if len(migrations) == 0 {
+		log.Println("The database is up to date")
+		return
+	}
+
+	if !*dryRun {
+		log.Printf("Applied %d migration(s)\n", len(migrations))
+		return
+	}
+
+	log.Printf("%d pending migration(s):\n", len(migrations))
+	for _, migration := range migrations {
+		fmt.Fprintf(os.Stdout, "-- %03d_%s\n%s\n", migration.Version, migration.Name, migration.SQL)
+	}
+}
@@ -0,0 +1,59 @@
+package prometheus
+
+import (
+	"strings"
+)
+
+// JSON-RPC methods of the Solana API, the only method names used as label values with the ones added by the operator (METRICS_METHODS)
+var knownMethods = map[string]bool{
+	"getAccountInfo": true, "getBalance": true, "getBlock": true, "getBlockCommitment": true, "getBlockHeight": true,
+	"getBlockProduction": true, "getBlockTime": true, "getBlocks": true, "getBlocksWithLimit": true, "getClusterNodes": true,
+	"getEpochInfo": true, "getEpochSchedule": true, "getFeeForMessage": true, "getFirstAvailableBlock": true, "getGenesisHash": true,
+	"getHealth": true, "getHighestSnapshotSlot": true, "getIdentity": true, "getInflationGovernor": true, "getInflationRate": true,
+	"getInflationReward": true, "getLargestAccounts": true, "getLatestBlockhash": true, "getLeaderSchedule": true,
+	"getMaxRetransmitSlot": true, "getMaxShredInsertSlot": true, "getMinimumBalanceForRentExemption": true,
+	"getMultipleAccounts": true, "getProgramAccounts": true, "getRecentPerformanceSamples": true,
+	"getRecentPrioritizationFees": true, "getSignatureStatuses": true, "getSignaturesForAddress": true, "getSlot": true,
+	"getSlotLeader": true, "getSlotLeaders": true, "getStakeMinimumDelegation": true, "getSupply": true,
+	"getTokenAccountBalance": true, "getTokenAccountsByDelegate": true, "getTokenAccountsByOwner": true,
+	"getTokenLargestAccounts": true, "getTokenSupply": true, "getTransaction": true, "getTransactionCount": true,
+	"getVersion": true, "getVoteAccounts": true, "isBlockhashValid": true, "minimumLedgerSlot": true,
+	"requestAirdrop": true, "sendTransaction": true, "simulateTransaction": true,
+}
+
+// AddMethodLabels adds methods to the ones used as label values (eg the methods of an RPC extension), separated by commas.
+// Must be called before the metrics are recorded
+func AddMethodLabels(methods string) {
+	for _, method := range strings.Split(methods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			knownMethods[method] = true
+		}
+	}
+}
+
+// MethodLabel returns the label value of a JSON-RPC method. Clients can send any method name,
+// so only the known methods get their own value to keep the cardinality of the series under control, the others are reported as "other"
+func MethodLabel(method string) string {
+	switch {
+	case method == "":
+		return "none"
+	case method == "batch" || knownMethods[method]:
+		return method
+	}
+	return "other"
+}
+
+// StatusClass returns the class of an HTTP status code (eg "2xx")
+func StatusClass(status int) string {
+	switch {
+	case status >= 500:
+		return "5xx"
+	case status >= 400:
+		return "4xx"
+	case status >= 300:
+		return "3xx"
+	case status >= 200:
+		return "2xx"
+	}
+	return "1xx"
+}
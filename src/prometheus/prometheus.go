@@ -18,6 +18,13 @@ var (
 			Help: "Number of requests blocked due to global rate limiting",
 		},
 	)
+	PriorityRateLimitHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "priority_rate_limit_hits",
+			Help: "Number of requests shed or blocked due to global rate limiting, per client priority",
+		},
+		[]string{"priority"},
+	)
 	PerNodeRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "per_node_requests",
@@ -32,6 +39,13 @@ var (
 		},
 		[]string{"node"},
 	)
+	UpstreamRateLimitHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_rate_limit_hits",
+			Help: "Number of 429 responses received from each RPC node",
+		},
+		[]string{"node"},
+	)
 	NodeErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "node_errors",
@@ -39,23 +53,197 @@ var (
 		},
 		[]string{"node"},
 	)
-	RequestLatency = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "request_latency_seconds",
-			Help:    "Latency of requests forwarded to RPC nodes",
-			Buckets: prometheus.DefBuckets,
+	MethodRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "method_requests_total",
+			Help: "Number of requests served, per JSON-RPC method, API key id and response status class",
+		},
+		[]string{"method", "key", "status_class"},
+	)
+	MethodErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "method_errors_total",
+			Help: "Number of failed attempts on the nodes (transport error, 403, 429 or 5xx), per JSON-RPC method and API key id",
+		},
+		[]string{"method", "key"},
+	)
+	Redirects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redirects_total",
+			Help: "Number of clients redirected to each RPC node (redirect mode)",
+		},
+		[]string{"node"},
+	)
+	NodeUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_up",
+			Help: "Whether requests are routed to the RPC node (1: enabled, not unhealthy and not draining, 0 otherwise)",
+		},
+		[]string{"node"},
+	)
+	NodeRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_rate_limit",
+			Help: "Configured rate limit of the RPC node (requests per second)",
+		},
+		[]string{"node"},
+	)
+	NodeBurstLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_burst_limit",
+			Help: "Configured burst limit of the RPC node",
+		},
+		[]string{"node"},
+	)
+	NodeQueueSlots = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_queue_slots",
+			Help: "Number of occurrences of the RPC node in the weighted round-robin queue",
+		},
+		[]string{"node"},
+	)
+	ActiveNodes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_nodes",
+			Help: "Number of RPC nodes requests are routed to",
+		},
+	)
+	UpstreamAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_attempts_total",
+			Help: "Number of requests forwarded to each RPC node, per outcome (success, error: transport error, 403 or 5xx, rate_limited: 429)",
+		},
+		[]string{"node", "outcome"},
+	)
+	NodeHealthChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_health_changes_total",
+			Help: "Number of changes of the health of each RPC node, per new state (healthy or unhealthy)",
+		},
+		[]string{"node", "state"},
+	)
+	HealthChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "health_checks_total",
+			Help: "Number of health checks of each RPC node, per result (success or failure)",
+		},
+		[]string{"node", "result"},
+	)
+	HealthCheckUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "health_check_up",
+			Help: "Result of the last health check of each RPC node (1: success, 0: failure)",
+		},
+		[]string{"node"},
+	)
+	UpstreamConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_connections",
+			Help: "Number of connections open to each RPC node, per state (active: serving requests, idle: kept for reuse)",
+		},
+		[]string{"node", "state"},
+	)
+	UpstreamConnectionsOpened = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_connections_opened_total",
+			Help: "Number of connections opened to each RPC node (a high rate compared to the requests means the connections are not reused)",
 		},
 		[]string{"node"},
 	)
 )
 
+// Default buckets of the latency histograms (seconds): RPC calls take from a few milliseconds to tens of seconds (large queries)
+var DEFAULT_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30}
+
+// Default buckets of the overhead histogram (seconds): the time spent in the balancer itself is well below the latency of the nodes
+var DEFAULT_OVERHEAD_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Latency histograms, created with their buckets by RegisterHistograms (the buckets are configured from the environment)
+var (
+	UpstreamTTFB     = newUpstreamTTFB(DEFAULT_LATENCY_BUCKETS)
+	UpstreamDuration = newUpstreamDuration(DEFAULT_LATENCY_BUCKETS)
+	BalancerOverhead = newBalancerOverhead(DEFAULT_OVERHEAD_BUCKETS)
+	MethodLatency    = newMethodLatency(DEFAULT_LATENCY_BUCKETS)
+)
+
+func newUpstreamTTFB(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_ttfb_seconds",
+			Help:    "Time to the response headers of the requests forwarded to RPC nodes",
+			Buckets: buckets,
+		},
+		[]string{"node"},
+	)
+}
+
+func newUpstreamDuration(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_duration_seconds",
+			Help:    "Total duration of the requests forwarded to RPC nodes, until the response body has been streamed to the client",
+			Buckets: buckets,
+		},
+		[]string{"node"},
+	)
+}
+
+func newBalancerOverhead(buckets []float64) prometheus.Histogram {
+	return prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "balancer_overhead_seconds",
+			Help:    "Time spent in the load balancer to serve a request (admission queue, node selection, proxying), excluding the time spent waiting for the nodes",
+			Buckets: buckets,
+		},
+	)
+}
+
+func newMethodLatency(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "method_request_duration_seconds",
+			Help:    "Time to serve the requests (retries included), per JSON-RPC method and API key id",
+			Buckets: buckets,
+		},
+		[]string{"method", "key"},
+	)
+}
+
+// RegisterHistograms creates the latency histograms with the given buckets, and registers them. Must be called once, before serving requests
+func RegisterHistograms(latencyBuckets []float64, overheadBuckets []float64) {
+	UpstreamTTFB = newUpstreamTTFB(latencyBuckets)
+	UpstreamDuration = newUpstreamDuration(latencyBuckets)
+	BalancerOverhead = newBalancerOverhead(overheadBuckets)
+	MethodLatency = newMethodLatency(latencyBuckets)
+
+	prometheus.MustRegister(UpstreamTTFB)
+	prometheus.MustRegister(UpstreamDuration)
+	prometheus.MustRegister(BalancerOverhead)
+	prometheus.MustRegister(MethodLatency)
+}
+
 
 func init() {
 	// Register Prometheus metrics
 	prometheus.MustRegister(TotalRequests)
 	prometheus.MustRegister(TotalRateLimitHits)
+	prometheus.MustRegister(PriorityRateLimitHits)
 	prometheus.MustRegister(PerNodeRequests)
 	prometheus.MustRegister(RateLimitHits)
+	prometheus.MustRegister(UpstreamRateLimitHits)
 	prometheus.MustRegister(NodeErrors)
-	prometheus.MustRegister(RequestLatency)
+	prometheus.MustRegister(MethodRequests)
+	prometheus.MustRegister(MethodErrors)
+	prometheus.MustRegister(Redirects)
+	prometheus.MustRegister(NodeUp)
+	prometheus.MustRegister(NodeRateLimit)
+	prometheus.MustRegister(NodeBurstLimit)
+	prometheus.MustRegister(NodeQueueSlots)
+	prometheus.MustRegister(ActiveNodes)
+	prometheus.MustRegister(UpstreamAttempts)
+	prometheus.MustRegister(NodeHealthChanges)
+	prometheus.MustRegister(HealthChecks)
+	prometheus.MustRegister(HealthCheckUp)
+	prometheus.MustRegister(UpstreamConnections)
+	prometheus.MustRegister(UpstreamConnectionsOpened)
 }
\ No newline at end of file
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig configures the access log of the proxied requests
+type AccessLogConfig struct {
+	// stdout, or file (written to File, rotated when it reaches MaxSize bytes, keeping MaxBackups old files)
+	Output     string
+	File       string
+	MaxSize    int64
+	MaxBackups int
+	// Fraction of the successful requests logged (failed requests are always logged)
+	SampleRatio float64
+	// Reverse proxies whose X-Real-IP header is the address of the client (anyone else could set it)
+	TrustedProxies []netip.Prefix
+}
+
+// AccessLogger writes one JSON line per proxied request
+type AccessLogger struct {
+	logger         *slog.Logger
+	sampleRatio    float64
+	trustedProxies []netip.Prefix
+	closer         io.Closer
+}
+
+// NewAccessLogger creates the access logger writing to the configured output
+func NewAccessLogger(config AccessLogConfig) (*AccessLogger, error) {
+	l := &AccessLogger{sampleRatio: config.SampleRatio, trustedProxies: config.TrustedProxies}
+
+	var out io.Writer
+	switch config.Output {
+	case "stdout":
+		out = os.Stdout
+	case "file":
+		file, err := newRotatingFile(config.File, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+		l.closer = file
+	default:
+		return nil, fmt.Errorf("invalid access log output: %s. Must be 'stdout' or 'file'", config.Output)
+	}
+
+	l.logger = slog.New(slog.NewJSONHandler(out, nil))
+	return l, nil
+}
+
+// Close closes the log file
+func (l *AccessLogger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// accessEntry collects what is known about a request while it is served
+type accessEntry struct {
+	start time.Time
+	// Method of the request ("batch" for a batch request), and the methods of each request of a batch
+	method   string
+	methods  []string
+	node     *Node
+	attempts int
+	// Time spent in the attempts on the nodes
+	upstream time.Duration
+}
+
+// log writes the entry of a request, unless it is sampled out
+func (l *AccessLogger) log(r *http.Request, w *accessRecorder, entry *accessEntry) {
+	status := w.statusCode()
+	if status < http.StatusBadRequest && l.sampleRatio < 1 && rand.Float64() >= l.sampleRatio {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("client_ip", clientIP(r, l.trustedProxies)),
+		slog.String("key_id", APIKeyIDFromContext(r.Context())),
+		slog.String("priority", PriorityFromContext(r.Context()).String()),
+		slog.String("http_method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Any("rpc_methods", entry.methods),
+		slog.Int("attempts", entry.attempts),
+		slog.Int("status", status),
+		slog.Int64("bytes", w.bytes),
+		slog.Float64("latency_ms", float64(time.Since(entry.start).Microseconds())/1000),
+	}
+	if entry.node != nil {
+		attrs = append(attrs, slog.Int("node_id", entry.node.ID), slog.String("node_url", entry.node.URL))
+	}
+
+	l.logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
+
+// Status recorded when the client went away before the response (as nginx does), it is never sent
+const statusClientClosedRequest = 499
+
+// accessRecorder records the status and size of the response written to the client
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered response to the client. Forwarded explicitly, since the writers are usually checked with a type assertion (http.Flusher)
+func (w *accessRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives access to the underlying writer (http.ResponseController)
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the status sent to the client (200 if nothing was written)
+func (w *accessRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// clientIP returns the address of the connection, or the one set by the reverse proxy (X-Real-IP) when the connection comes from a trusted proxy
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := r.Header.Get("X-Real-IP")
+	if ip == "" {
+		return host
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(addr.Unmap()) {
+			return ip
+		}
+	}
+	return host
+}
+
+// APIKeyID identifies an API key in the logs without revealing it (first bytes of its SHA-256)
+func APIKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+type apiKeyIDContextKey struct{}
+
+// WithAPIKeyID returns a copy of the context carrying the id of the API key of the request
+func WithAPIKeyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, apiKeyIDContextKey{}, id)
+}
+
+// APIKeyIDFromContext returns the id of the API key of the request, or "" if none was set
+func APIKeyIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDContextKey{}).(string)
+	return id
+}
+
+// rotatingFile is a log file renamed to <path>.1 (and the older ones to <path>.2, ...) when it reaches maxSize bytes
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if path == "" {
+		return nil, fmt.Errorf("an access log file is required when writing the access log to a file")
+	}
+
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
+
+// open opens the log file for appending. Must be called with the mutex held
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log file: %v", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups, dropping the oldest one, and starts a new file (the current file is kept if it cannot be renamed). Must be called with the mutex held
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to rotate access log file: %v", err)
+	}
+
+	var renameErr error
+	if f.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		renameErr = os.Rename(f.path, f.path+".1")
+	} else {
+		renameErr = os.Remove(f.path)
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	// The same file has been reopened: counted as empty, so that it grows by maxSize again before the next attempt instead of rotating on each write
+	if renameErr != nil {
+		log.Printf("Failed to rotate access log file: %v\n", renameErr)
+		f.size = 0
+	}
+	return nil
+}
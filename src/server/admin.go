@@ -0,0 +1,494 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerInput is the body of the admin requests creating (url and limits required) or editing (any field) a server.
+// The health of a server cannot be set, it is only observed by the balancer
+type ServerInput struct {
+	URL        *string `json:"url"`
+	RateLimit  *int    `json:"rate_limit"`
+	BurstLimit *int    `json:"burst_limit"`
+	AdminState *string `json:"admin_state"`
+	Reason     *string `json:"reason"`
+	Draining   *bool   `json:"draining"`
+	// Replaces the TLS configuration ({} to reset it). The client key can be sent back as "[redacted]" to keep the stored one
+	TLS        *ServerTLS `json:"tls"`
+	// Replaces the credentials ({} to remove them). The values can be sent back as "[redacted]" to keep the stored ones
+	Auth       *ServerAuth `json:"auth"`
+}
+
+// StateInput is the optional body of the requests enabling or disabling a server
+type StateInput struct {
+	Reason string `json:"reason"`
+}
+
+// HandleListServers returns all the servers of the store (active or not)
+func (b *Balancer) HandleListServers(w http.ResponseWriter, r *http.Request) {
+	servers, err := b.ServerManager.store.GetServers(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get servers: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, redactServers(servers))
+}
+
+// HandleCreateServer adds a server to the store and to the balancer
+func (b *Balancer) HandleCreateServer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var input ServerInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if input.URL == nil || input.RateLimit == nil || input.BurstLimit == nil {
+		http.Error(w, "url, rate_limit and burst_limit are required", http.StatusBadRequest)
+		return
+	}
+
+	server := &RPCServer{AdminState: AdminEnabled}
+	if status, err := b.applyServerInput(r, server, input); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := b.ServerManager.store.CreateServer(ctx, server); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	log.Printf("Server %d (%s) created\n", server.ID, server.URL)
+	b.ServerManager.recordEvent(ctx, &ServerEvent{ServerID: server.ID, Type: EventCreated, ToState: string(server.AdminState), Reason: server.AdminReason, Actor: adminActor(r)})
+	b.rebuildCache(r)
+
+	writeServer(w, http.StatusCreated, server)
+}
+
+// HandleUpdateServer edits the given fields of a server, in the store and in the balancer
+func (b *Balancer) HandleUpdateServer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	server, ok := b.serverFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var input ServerInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	before := *server
+	if status, err := b.applyServerInput(r, server, input); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := b.ServerManager.store.UpdateServer(ctx, server); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	log.Printf("Server %d (%s) updated\n", server.ID, server.URL)
+	b.recordUpdateEvents(r, &before, server)
+	b.rebuildCache(r)
+
+	writeServer(w, http.StatusOK, server)
+}
+
+// HandleDeleteServer removes a server from the store and from the balancer
+func (b *Balancer) HandleDeleteServer(w http.ResponseWriter, r *http.Request) {
+	server, ok := b.serverFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := b.ServerManager.store.DeleteServer(r.Context(), server.ID); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	log.Printf("Server %d (%s) deleted\n", server.ID, server.URL)
+	b.ServerManager.recordEvent(r.Context(), &ServerEvent{ServerID: server.ID, Type: EventDeleted, Reason: server.URL, Actor: adminActor(r)})
+	b.rebuildCache(r)
+	forgetNodeMetrics(server.URL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDrainServer takes a server out of rotation for maintenance: no new requests are routed to it, in-flight ones complete (see the state of the node in /stats)
+func (b *Balancer) HandleDrainServer(w http.ResponseWriter, r *http.Request) {
+	b.setServerDraining(w, r, true)
+}
+
+// HandleUndrainServer puts a drained server back in rotation
+func (b *Balancer) HandleUndrainServer(w http.ResponseWriter, r *http.Request) {
+	b.setServerDraining(w, r, false)
+}
+
+func (b *Balancer) setServerDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	server, ok := b.serverFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := b.ServerManager.setServerDraining(r.Context(), server, draining, adminActor(r)); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	log.Printf("Server %d (%s) draining: %v\n", server.ID, server.URL, draining)
+	server.Draining = draining
+
+	writeServer(w, http.StatusOK, server)
+}
+
+// HandleEnableServer enables a server disabled by an operator (it is routed to again, unless it is unhealthy)
+func (b *Balancer) HandleEnableServer(w http.ResponseWriter, r *http.Request) {
+	b.setServerAdminState(w, r, AdminEnabled)
+}
+
+// HandleDisableServer disables a server: it is not routed to, whatever its health, until it is enabled again
+func (b *Balancer) HandleDisableServer(w http.ResponseWriter, r *http.Request) {
+	b.setServerAdminState(w, r, AdminDisabled)
+}
+
+func (b *Balancer) setServerAdminState(w http.ResponseWriter, r *http.Request, state AdminState) {
+	server, ok := b.serverFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional
+	var input StateInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := b.ServerManager.setServerAdminState(r.Context(), server, state, input.Reason, adminActor(r)); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+
+	log.Printf("Server %d (%s) %s: %s\n", server.ID, server.URL, state, input.Reason)
+	server.setAdminState(state, input.Reason)
+
+	writeServer(w, http.StatusOK, server)
+}
+
+// HandleServerEvents returns the latest state changes of a server, most recent first (?limit=, 100 by default). Events of deleted servers are kept
+func (b *Balancer) HandleServerEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid server id", http.StatusBadRequest)
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "Invalid limit: must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := b.ServerManager.store.GetServerEvents(r.Context(), id, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []*ServerEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+// HandleSLAReport returns the availability, error rate and latency percentiles of every node and provider over the SLA windows (?format=json, default, or csv)
+func (b *Balancer) HandleSLAReport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "Invalid format: must be 'json' or 'csv'", http.StatusBadRequest)
+		return
+	}
+
+	report, err := b.ServerManager.slaReport(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to compute the SLA report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sla-%s.csv\"", report.GeneratedAt.UTC().Format("2006-01-02T15-04-05")))
+
+	// One row per node (or provider) and window
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"scope", "id", "url", "provider", "window", "requests", "errors", "rate_limited", "probes", "probe_failures", "availability", "error_rate", "latency_p50_ms", "latency_p95_ms", "latency_p99_ms"})
+	for _, node := range report.Nodes {
+		for _, window := range SLA_WINDOWS {
+			writer.Write(slaRow("node", strconv.Itoa(node.ID), node.URL, node.Provider, window.Name, node.Windows[window.Name]))
+		}
+	}
+	for _, provider := range report.Providers {
+		for _, window := range SLA_WINDOWS {
+			writer.Write(slaRow("provider", "", "", provider.Provider, window.Name, provider.Windows[window.Name]))
+		}
+	}
+	writer.Flush()
+}
+
+// slaRow formats the stats of a window as a CSV row (empty availability and error rate without data)
+func slaRow(scope, id, url, provider, window string, stats SLAStats) []string {
+	optional := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+
+	return []string{
+		scope, id, url, provider, window,
+		strconv.FormatInt(stats.Requests, 10),
+		strconv.FormatInt(stats.Errors, 10),
+		strconv.FormatInt(stats.RateLimited, 10),
+		strconv.FormatInt(stats.Probes, 10),
+		strconv.FormatInt(stats.ProbeFailures, 10),
+		optional(stats.Availability),
+		optional(stats.ErrorRate),
+		strconv.FormatFloat(stats.LatencyP50, 'f', -1, 64),
+		strconv.FormatFloat(stats.LatencyP95, 'f', -1, 64),
+		strconv.FormatFloat(stats.LatencyP99, 'f', -1, 64),
+	}
+}
+
+// recordUpdateEvents records the changes made by an edit: admin state and draining have their own events, the url and limits are reported together
+func (b *Balancer) recordUpdateEvents(r *http.Request, before *RPCServer, after *RPCServer) {
+	ctx := r.Context()
+	actor := adminActor(r)
+
+	if before.AdminState != after.AdminState {
+		b.ServerManager.recordEvent(ctx, &ServerEvent{ServerID: after.ID, Type: EventAdmin, FromState: string(before.AdminState), ToState: string(after.AdminState), Reason: after.AdminReason, Actor: actor})
+	}
+
+	if before.Draining != after.Draining {
+		b.ServerManager.recordEvent(ctx, &ServerEvent{ServerID: after.ID, Type: EventDraining, FromState: drainingState(before.Draining), ToState: drainingState(after.Draining), Actor: actor})
+	}
+
+	var changes []string
+	if before.URL != after.URL {
+		changes = append(changes, fmt.Sprintf("url from %s to %s", before.URL, after.URL))
+	}
+	if before.RateLimit != after.RateLimit {
+		changes = append(changes, fmt.Sprintf("rate_limit from %d to %d", before.RateLimit, after.RateLimit))
+	}
+	if before.BurstLimit != after.BurstLimit {
+		changes = append(changes, fmt.Sprintf("burst_limit from %d to %d", before.BurstLimit, after.BurstLimit))
+	}
+	if !before.TLS.equal(after.TLS) {
+		changes = append(changes, "tls settings")
+	}
+	if !before.Auth.equal(after.Auth) {
+		changes = append(changes, "auth settings")
+	}
+	if len(changes) > 0 {
+		b.ServerManager.recordEvent(ctx, &ServerEvent{ServerID: after.ID, Type: EventUpdated, Reason: strings.Join(changes, ", "), Actor: actor})
+	}
+}
+
+// adminActor identifies the operator in the events (the admin key is shared, so by the address of the client)
+func adminActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "admin (" + host + ")"
+}
+
+// serverFromPath loads the server whose id is in the request path ({id}). Writes the error response and returns false if it cannot be found
+func (b *Balancer) serverFromPath(w http.ResponseWriter, r *http.Request) (*RPCServer, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid server id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	server, err := b.ServerManager.store.GetServer(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return server, true
+}
+
+// applyServerInput validates the input and applies it to the server. Returns the HTTP status to answer with if the input is invalid
+func (b *Balancer) applyServerInput(r *http.Request, server *RPCServer, input ServerInput) (int, error) {
+	if input.RateLimit != nil {
+		if *input.RateLimit <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("rate_limit must be positive")
+		}
+		server.RateLimit = *input.RateLimit
+	}
+
+	if input.BurstLimit != nil {
+		if *input.BurstLimit <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("burst_limit must be positive")
+		}
+		server.BurstLimit = *input.BurstLimit
+	}
+
+	if input.AdminState != nil {
+		state, err := ParseAdminState(*input.AdminState)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if state != server.AdminState {
+			server.AdminReason = ""
+		}
+		server.AdminState = state
+	}
+
+	if input.Reason != nil {
+		server.AdminReason = *input.Reason
+	}
+
+	if input.Draining != nil {
+		server.Draining = *input.Draining
+	}
+
+	if input.TLS != nil {
+		settings := *input.TLS
+		if settings.ClientKey == REDACTED {
+			if server.TLS == nil {
+				return http.StatusBadRequest, fmt.Errorf("tls client_key is required")
+			}
+			settings.ClientKey = server.TLS.ClientKey
+		}
+		if _, err := settings.config(); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		server.TLS = &settings
+		if settings.isZero() {
+			server.TLS = nil
+		}
+	}
+
+	if input.Auth != nil {
+		auth := *input.Auth
+		if err := auth.keepSecrets(server.Auth); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if err := auth.validate(); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		server.Auth = &auth
+		if auth.isZero() {
+			server.Auth = nil
+		}
+	}
+
+	// Always validated on creation (the new server has no id yet, nor URL), and on update when the URL changes
+	if input.URL != nil && (server.ID == 0 || *input.URL != server.URL) {
+		parsed, err := url.Parse(*input.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return http.StatusBadRequest, fmt.Errorf("url must be an absolute http(s) URL")
+		}
+
+		existing, err := b.ServerManager.store.GetServerByURL(r.Context(), *input.URL)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if existing != nil {
+			return http.StatusConflict, fmt.Errorf("a server with url %s already exists (id %d)", *input.URL, existing.ID)
+		}
+
+		// Checked with the TLS configuration of the server
+		candidate := *server
+		candidate.URL = *input.URL
+		if err := b.ServerManager.isReachable(&candidate); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("url is not reachable: %v", err)
+		}
+
+		server.URL = *input.URL
+	}
+
+	return 0, nil
+}
+
+// rebuildCache applies the edits to the balancer right away (instead of waiting for the next cache refresh)
+func (b *Balancer) rebuildCache(r *http.Request) {
+	if err := b.ServerManager.rebuildCache(r.Context()); err != nil {
+		log.Printf("Error rebuilding cache: %v", err)
+	}
+}
+
+// isReachable sends the health check request to the server, any HTTP response means the server is reachable
+func (sm *ServerManager) isReachable(server *RPCServer) error {
+	client, err := newServerClient(server, sm.transport, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	req, err := sm.newHealthCheckRequest(server)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return server.Auth.redactError(err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// storeErrorStatus returns the HTTP status of a store error
+func storeErrorStatus(err error) int {
+	if errors.Is(err, ErrReadOnlyStore) {
+		return http.StatusMethodNotAllowed
+	}
+	return http.StatusInternalServerError
+}
+
+// writeServer writes a server as the JSON response of the admin API, without its secrets
+func writeServer(w http.ResponseWriter, status int, server *RPCServer) {
+	writeJSON(w, status, server.redacted())
+}
+
+// writeJSON writes a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AdminAuth is the middleware of the admin endpoints. The admin key can be sent in the "Authorization" header as a Bearer token,
+// or as the password of a Basic authentication (for the browsers, eg the dashboard).
+// Browsers send cached Basic credentials with any request, including the ones forged by another site (CSRF),
+// so the requests changing a state are only accepted with Basic from the dashboard itself (see sameOriginRequest)
+func AdminAuth(adminKey string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); ok {
+			if password != adminKey {
+				unauthorizedAdmin(w)
+				return
+			}
+
+			if !safeMethod(r.Method) && !sameOriginRequest(r) {
+				http.Error(w, "Cross-site request refused, send the X-Requested-With header or use the Bearer token", http.StatusForbidden)
+				return
+			}
+
+			next(w, r)
+			return
+		}
+
+		authKey := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(authKey) != 2 || authKey[0] != "Bearer" {
+			unauthorizedAdmin(w)
+			return
+		}
+
+		if authKey[1] != adminKey {
+			unauthorizedAdmin(w)
+			return
+		}
+
+		// Call the next handler
+		next(w, r)
+	}
+}
+
+// safeMethod returns true for the methods that do not change any state
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOriginRequest returns true if the request has been sent by a page of the balancer (or by a client that is not a browser).
+// X-Requested-With cannot be set by a cross-site page without a CORS preflight, which the balancer does not allow.
+// The fetch metadata of the browsers (Sec-Fetch-Site) and the Origin header are checked as well
+func sameOriginRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "" {
+		return false
+	}
+
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		_, host, found := strings.Cut(origin, "://")
+		if !found || host != r.Host {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unauthorizedAdmin rejects an admin request, asking the browsers for the API key (as the password)
+func unauthorizedAdmin(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Load balancer admin", charset="UTF-8"`)
+	http.Error(w, "Invalid API key", http.StatusUnauthorized)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrShed is returned when a request is rejected because the balancer is overloaded
+var ErrShed = errors.New("request shed: load balancer overloaded")
+
+// waiter is a request waiting for an admission slot
+type waiter struct {
+	// Receives true when the request is admitted, false when it is shed
+	ready chan bool
+}
+
+// Admission limits the number of requests served concurrently.
+// When all the slots are taken, requests wait in a queue per priority and are admitted using a weighted round-robin over the priorities (higher priorities get more turns, lower ones are not starved).
+// When the queues are full, the lowest priority requests are shed first.
+type Admission struct {
+	mutex       sync.Mutex
+	maxInFlight int
+	maxQueued   int
+	timeout     time.Duration
+	inFlight    int
+	queued      int
+	queues      [numPriorities][]*waiter
+	weights     [numPriorities]float64
+}
+
+// NewAdmission creates an admission controller serving at most maxInFlight requests at once, and keeping at most maxQueued requests waiting for up to timeout
+func NewAdmission(maxInFlight, maxQueued int, timeout time.Duration) *Admission {
+	return &Admission{
+		maxInFlight: maxInFlight,
+		maxQueued:   maxQueued,
+		timeout:     timeout,
+	}
+}
+
+// Acquire waits for an admission slot. Returns ErrShed if the request has been shed (queues full, or waited too long), or the context error if the client went away.
+// Every successful call must be followed by a call to Release
+func (a *Admission) Acquire(ctx context.Context, p Priority) error {
+	a.mutex.Lock()
+
+	// Free slot and nobody waiting, admit right away
+	if a.inFlight < a.maxInFlight && a.queued == 0 {
+		a.inFlight++
+		a.mutex.Unlock()
+		return nil
+	}
+
+	// Queues are full, make room by shedding a lower priority request, otherwise shed this one
+	if a.queued >= a.maxQueued && !a.shedLowerThan(p) {
+		a.mutex.Unlock()
+		return ErrShed
+	}
+
+	w := &waiter{ready: make(chan bool, 1)}
+	a.queues[p] = append(a.queues[p], w)
+	a.queued++
+	a.mutex.Unlock()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case admitted := <-w.ready:
+		if admitted {
+			return nil
+		}
+		return ErrShed
+	case <-timer.C:
+		err = ErrShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Gave up waiting, remove from the queue (unless it has been admitted or shed in the meantime)
+	a.mutex.Lock()
+	if a.remove(p, w) {
+		a.mutex.Unlock()
+		return err
+	}
+	a.mutex.Unlock()
+
+	if <-w.ready {
+		// Admitted concurrently, give the slot back
+		a.Release()
+	}
+	return err
+}
+
+// Release frees an admission slot and hands it to the next waiting request, if any
+func (a *Admission) Release() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.inFlight--
+
+	for a.inFlight < a.maxInFlight && a.queued > 0 {
+		w := a.dequeue()
+		a.inFlight++
+		w.ready <- true
+	}
+}
+
+// InFlight returns the number of requests currently admitted
+func (a *Admission) InFlight() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.inFlight
+}
+
+// Queued returns the number of requests waiting for a slot
+func (a *Admission) Queued() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.queued
+}
+
+// dequeue pops the next waiter, using the same smooth weighted round-robin as the server queue. Must be called with the mutex held and at least one request queued
+func (a *Admission) dequeue() *waiter {
+	total := 0.0
+	maxWeight := math.Inf(-1)
+	selected := -1
+
+	for i := range a.queues {
+		if len(a.queues[i]) == 0 {
+			continue
+		}
+		a.weights[i] += float64(PRIORITY_WEIGHTS[i])
+		total += float64(PRIORITY_WEIGHTS[i])
+		if a.weights[i] > maxWeight {
+			maxWeight = a.weights[i]
+			selected = i
+		}
+	}
+	a.weights[selected] -= total
+
+	w := a.queues[selected][0]
+	a.queues[selected] = a.queues[selected][1:]
+	a.queued--
+
+	// Reset the weights once everything has been drained, so that a burst does not benefit from past credits
+	if a.queued == 0 {
+		a.weights = [numPriorities]float64{}
+	}
+	return w
+}
+
+// shedLowerThan sheds the most recent waiter of the lowest priority below p. Returns false if there is none. Must be called with the mutex held
+func (a *Admission) shedLowerThan(p Priority) bool {
+	for i := 0; i < int(p); i++ {
+		if n := len(a.queues[i]); n > 0 {
+			w := a.queues[i][n-1]
+			a.queues[i] = a.queues[i][:n-1]
+			a.queued--
+			w.ready <- false
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes the waiter from its queue. Returns false if it was no longer queued. Must be called with the mutex held
+func (a *Admission) remove(p Priority, w *waiter) bool {
+	for i, queued := range a.queues[p] {
+		if queued == w {
+			a.queues[p] = append(a.queues[p][:i], a.queues[p][i+1:]...)
+			a.queued--
+			return true
+		}
+	}
+	return false
+}
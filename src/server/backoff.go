@@ -0,0 +1,207 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Back-off applied to a node answering 429 without a Retry-After header (doubled on each consecutive 429).
+// BACKOFF_MAX also caps the pauses asked by the nodes (Retry-After, rate limit reset)
+var (
+	BACKOFF_BASE time.Duration = time.Second
+	BACKOFF_MAX  time.Duration = 5 * time.Minute
+)
+
+// backoff pauses a node after it asked us to slow down (429), and remembers until when its rate is lowered to the limit of its provider
+type backoff struct {
+	mutex    sync.Mutex
+	until    time.Time
+	failures int
+	// End of the window of the provider limit the rate of the node is lowered to (zero if not lowered)
+	tunedUntil time.Time
+}
+
+// Paused returns true while the node must not receive requests
+func (b *backoff) Paused() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Now().Before(b.until)
+}
+
+// PausedUntil returns when the current pause ends (in the past if the node is not paused)
+func (b *backoff) PausedUntil() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.until
+}
+
+// Pause pauses the node for the given duration, or for an exponential default if the duration is unknown (<= 0), at most BACKOFF_MAX
+func (b *backoff) Pause(duration time.Duration) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if duration <= 0 {
+		duration = time.Duration(math.Min(
+			float64(BACKOFF_BASE)*math.Pow(2, float64(b.failures)),
+			float64(BACKOFF_MAX),
+		))
+	}
+	// A node must not be paused for hours because of a wrong header
+	duration = min(duration, BACKOFF_MAX)
+	b.failures++
+
+	if until := time.Now().Add(duration); until.After(b.until) {
+		b.until = until
+	}
+	return duration
+}
+
+// Reset clears the consecutive failures, once the node answered normally again
+func (b *backoff) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+}
+
+// Tune records that the rate of the node is lowered until the given time
+func (b *backoff) Tune(until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tunedUntil = until
+}
+
+// TunedUntil returns when the lowered rate of the node expires (zero if not lowered)
+func (b *backoff) TunedUntil() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.tunedUntil
+}
+
+// TuningExpired returns true once, when the lowered rate of the node has expired
+func (b *backoff) TuningExpired() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tunedUntil.IsZero() || time.Now().Before(b.tunedUntil) {
+		return false
+	}
+	b.tunedUntil = time.Time{}
+	return true
+}
+
+// parseRetryAfter parses a Retry-After header (delay in seconds or HTTP date). Returns 0 if absent or invalid
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		// Capped before the conversion, which would overflow for huge values
+		if seconds > int(BACKOFF_MAX/time.Second) {
+			return BACKOFF_MAX
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// parseRateLimitReset parses a rate limit reset header, which is either a delay in seconds or a unix timestamp (in seconds or milliseconds) depending on the provider.
+// The delay is capped at BACKOFF_MAX
+func parseRateLimitReset(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	var delay time.Duration
+	switch {
+	// Timestamps in milliseconds (1e12 ms is 2001, 1e12 s is 33 000 years from now)
+	case seconds > 1e12:
+		delay = time.Until(time.UnixMilli(int64(seconds)))
+	// Anything larger than a year is a timestamp
+	case seconds > 365*24*3600:
+		delay = time.Until(time.Unix(int64(seconds), 0))
+	default:
+		delay = time.Duration(seconds * float64(time.Second))
+	}
+	return min(delay, BACKOFF_MAX)
+}
+
+// firstHeader returns the first non-empty header among the given names
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// tuneFromRateLimitHeaders adapts the node to the rate limit headers of its provider (X-RateLimit-*, RateLimit-*):
+//   - when no request remains, the node is paused until the limit resets
+//   - when the provider limit is lower than the configured one, the limiter is lowered accordingly until the end of the window of the limit
+//     (restored by restoreRateLimit). The limit is ignored without window (RateLimit-Policy w=, or the delay until the reset): it could be per second as well as per day
+func (node *Node) tuneFromRateLimitHeaders(header http.Header) {
+	reset := parseRateLimitReset(firstHeader(header, "X-RateLimit-Reset", "RateLimit-Reset"))
+
+	if remaining := firstHeader(header, "X-RateLimit-Remaining", "RateLimit-Remaining"); remaining != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(remaining)); err == nil && n <= 0 && reset > 0 {
+			node.backoff.Pause(reset)
+		}
+	}
+
+	limitStr := firstHeader(header, "X-RateLimit-Limit", "RateLimit-Limit")
+	if limitStr == "" {
+		return
+	}
+
+	// The limit can be followed by its policy, eg "100, 100;w=10" (quota of 100 requests per 10 seconds)
+	limitStr, policy, _ := strings.Cut(limitStr, ",")
+	limit, err := strconv.ParseFloat(strings.TrimSpace(limitStr), 64)
+	if err != nil || limit <= 0 {
+		return
+	}
+
+	// Without policy, the window ends at the latest when the limit resets: the rate is at most limit / window
+	window := reset
+	if policy == "" {
+		policy = header.Get("RateLimit-Policy")
+	}
+	if _, w, found := strings.Cut(policy, "w="); found {
+		if seconds, err := strconv.ParseFloat(strings.TrimSpace(strings.Split(w, ";")[0]), 64); err == nil && seconds > 0 {
+			window = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if window <= 0 {
+		return
+	}
+
+	providerRate := min(rate.Limit(limit/window.Seconds()), rate.Limit(node.RateLimit))
+	if providerRate != node.limiter.Limit() {
+		node.limiter.SetLimit(providerRate)
+	}
+	if providerRate < rate.Limit(node.RateLimit) {
+		node.backoff.Tune(time.Now().Add(window))
+	} else {
+		node.backoff.Tune(time.Time{})
+	}
+}
+
+// restoreRateLimit restores the configured rate of the node once the window of the provider limit it was lowered to has ended
+func (node *Node) restoreRateLimit() {
+	if node.backoff.TuningExpired() {
+		node.limiter.SetLimit(rate.Limit(node.RateLimit))
+	}
+}
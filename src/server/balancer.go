@@ -2,8 +2,9 @@ package server
 
 import (
 	"load-balancer/src/prometheus"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,63 +12,151 @@ import (
 	"net/url"
 	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var MAX_NODES_TRIED int = 5
 
+// Largest request body accepted in proxy mode, the body is kept in memory to retry the request on another node
+var MAX_REQUEST_BODY_BYTES int64 = 10 << 20
+
 // Balancer struct with server manager
 type Balancer struct {
 	ServerManager *ServerManager
 	ReverseProxy bool
+	// Admission limits the number of requests served concurrently and sheds the lowest priorities first when overloaded (nil to disable)
+	Admission *Admission
+	// AccessLog writes a structured line per request (nil to disable)
+	AccessLog *AccessLogger
 }
 
-// handleStats returns statistics about the servers
-func (b *Balancer) HandleStats(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	servers, err := b.ServerManager.getActiveServers(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get servers: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"active_servers": len(servers),
-		"servers":        servers,
-	})
-}
+// makeRequest proxies the request to the node. Returns false if the request must be retried on another node (nothing has been written to the client).
+// attempt is the index of the attempt (0 for the first node tried), method the JSON-RPC method of the request
+func (b *Balancer) makeRequest(ctx context.Context, url *url.URL, w http.ResponseWriter, r *http.Request, body []byte, node *Node, method string, attempt int) bool {
+	// Each attempt is a child span of the request
+	ctx, span := tracer.Start(ctx, "upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int("node.id", node.ID),
+			attribute.String("node.url", node.URL),
+			attribute.String("rpc.method", method),
+			attribute.Int("retry.index", attempt),
+		))
+	defer span.End()
 
+	// Respect the concurrency limit learned for this node
+	if !node.concurrency.Acquire() {
+		prometheus.RateLimitHits.WithLabelValues(node.URL).Inc()
+		span.SetStatus(codes.Error, "concurrency limit reached")
+		return false
+	}
 
-func (b *Balancer) makeRequest(ctx context.Context, url *url.URL, w http.ResponseWriter, r *http.Request, node *Node) bool {
 	// Start timing the request
 	start := time.Now()
 
-	forwardReq, err := http.NewRequestWithContext(ctx, r.Method, url.String(), r.Body)
-	forwardReq.RemoteAddr = r.RemoteAddr
-	
+	// Feed the outcome of the request (latency, node failure) back to the concurrency limiter, unless the client went away.
+	// The latency is the time to the response headers: streaming the body depends on the client, a slow reader must not lower the limit of the node
+	dropped := false
+	canceled := false
+	var ttfb time.Duration
+	defer func() {
+		if canceled {
+			node.concurrency.Cancel()
+			return
+		}
+		if ttfb == 0 {
+			ttfb = time.Since(start)
+		}
+		node.concurrency.Release(ttfb, dropped)
+	}()
+
+	// Follow the connection used by the request, for the pool metrics of the node
+	ctx, release := node.conns.track(ctx)
+	defer release()
+
+	// The body has been read beforehand, so that the request can be replayed on another node
+	forwardReq, err := http.NewRequestWithContext(ctx, r.Method, url.String(), bytes.NewReader(body))
 	if err != nil {
-		http.Error(w, "Failed to create forward request", http.StatusInternalServerError)
+		log.Printf("Failed to create forward request to node %s: %v\n", node.URL, err)
 		return false
 	}
+	forwardReq.RemoteAddr = r.RemoteAddr
 
 	// Copy the headers from the original request
 	forwardReq.Header = r.Header.Clone()
-	forwardReq.ContentLength = r.ContentLength
+	forwardReq.ContentLength = int64(len(body))
+
+	// Propagate the trace to the node (W3C traceparent), replacing the one of the client
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(forwardReq.Header))
 
+	// Credentials of the node (paid providers), replacing the ones sent by the client
+	node.Auth.apply(forwardReq)
 
 	// Make the request
-	resp, err := http.DefaultClient.Do(forwardReq)
+	resp, err := node.client.Do(forwardReq)
 	if err != nil {
+		// A request canceled by the client is not a failure of the node
+		if r.Context().Err() != nil {
+			canceled = true
+			span.SetStatus(codes.Error, "request canceled by the client")
+			return false
+		}
+
+		// The error holds the URL of the request, with the query credentials
+		err = node.Auth.redactError(err)
 		// Node might be down or other error
 		// Increment error counter for this node
 		prometheus.NodeErrors.WithLabelValues(node.URL).Inc()
+		prometheus.MethodErrors.WithLabelValues(prometheus.MethodLabel(method), APIKeyIDFromContext(ctx)).Inc()
+		b.ServerManager.sla.recordRequest(node.ID, slaError, time.Since(start))
+		prometheus.UpstreamAttempts.WithLabelValues(node.URL, slaError.String()).Inc()
 		log.Printf("Node %s request error: %v\n", node.URL, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "request to the node failed")
+		dropped = true
 		return false
 	}
 	defer resp.Body.Close()
 
-	// Record latency
-	prometheus.RequestLatency.WithLabelValues(node.URL).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden {
+		span.SetStatus(codes.Error, fmt.Sprintf("node responded %d", resp.StatusCode))
+	}
+
+	// Record the time to first byte (the total duration is recorded once the body has been streamed)
+	ttfb = time.Since(start)
+	prometheus.UpstreamTTFB.WithLabelValues(node.URL).Observe(ttfb.Seconds())
+
+	// Record the outcome for the SLA of the node (403 means the node refuses to serve us)
+	outcome := slaSuccess
+	if resp.StatusCode == http.StatusTooManyRequests {
+		outcome = slaRateLimited
+	} else if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusForbidden {
+		outcome = slaError
+	}
+	b.ServerManager.sla.recordRequest(node.ID, outcome, ttfb)
+	prometheus.UpstreamAttempts.WithLabelValues(node.URL, outcome.String()).Inc()
+	if outcome != slaSuccess {
+		prometheus.MethodErrors.WithLabelValues(prometheus.MethodLabel(method), APIKeyIDFromContext(ctx)).Inc()
+	}
+
+	// The node asks us to slow down: pause it (for Retry-After, or an exponential back-off) and retry the request on another node.
+	// Its concurrency limit is lowered as well, it must not grow while the node is rate limiting us
+	if resp.StatusCode == http.StatusTooManyRequests {
+		dropped = true
+		pause := node.backoff.Pause(parseRetryAfter(resp.Header.Get("Retry-After")))
+		node.tuneFromRateLimitHeaders(resp.Header)
+		prometheus.UpstreamRateLimitHits.WithLabelValues(node.URL).Inc()
+		log.Printf("Node %s rate limited the request, pausing it for %v\n", node.URL, pause)
+		return false
+	}
+	node.backoff.Reset()
+	node.tuneFromRateLimitHeaders(resp.Header)
 
 	// Write the response code and headers back to the client
 	for key, values := range resp.Header {
@@ -77,46 +166,123 @@ func (b *Balancer) makeRequest(ctx context.Context, url *url.URL, w http.Respons
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	// If received a forbidden status code, then set the server as inactive. A goroutine will check the server status and set it as active again if it is up.
+	// Server errors mean the node is struggling, lower its concurrency limit
+	dropped = resp.StatusCode >= http.StatusInternalServerError
+
+	// If received a forbidden status code, then set the server as unhealthy. A goroutine will check the server status and set it as healthy again if it is up.
 	if resp.StatusCode == http.StatusForbidden {
-		go b.ServerManager.setServerActive(node.RPCServer, false)
+		go b.ServerManager.setServerHealth(node.RPCServer, HealthUnhealthy, "403 Forbidden from the node", ActorBalancer)
 	}
 
-	// Stream the response body
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	// Stream the response body (the response has started, it can no longer be retried on another node).
+	// The responses of unknown length are streamed by the node, they are flushed to the client as they come
+	var client io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok && resp.ContentLength < 0 {
+		client = flushWriter{w, flusher}
+	}
+	if _, err := io.Copy(client, resp.Body); err != nil {
 		log.Printf("Error copying response body: %v\n", err)
-		return false
 	}
+	prometheus.UpstreamDuration.WithLabelValues(node.URL).Observe(time.Since(start).Seconds())
 
 	return true
 }
 
+// flushWriter flushes every write to the client
+type flushWriter struct {
+	io.Writer
+	flusher http.Flusher
+}
+
+func (w flushWriter) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	w.flusher.Flush()
+	return n, err
+}
+
 func (b *Balancer) makeRedirect(url *url.URL, w http.ResponseWriter, r *http.Request, node *Node) {
-	// Start timing the request
-	start := time.Now()
-	// Balancer set as redirect -> Redirect the client to the node's URL
+	// Balancer set as redirect -> Redirect the client to the node's URL (the balancer never sees the request to the node, there is no latency to record)
 	http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
-	
-	// Record latency
-	prometheus.RequestLatency.WithLabelValues(node.URL).Observe(time.Since(start).Seconds())
+	prometheus.Redirects.WithLabelValues(node.URL).Inc()
 }
 
 // handleRequest receives the client request, picks an available node,
 // and then proxifies the request to that node (if not rate-limited).
 func (b *Balancer) HandleRequest(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	priority := PriorityFromContext(r.Context())
 
+	// The status and size of the response are recorded for the metrics and the access log, written once the request has been served
+	recorder := &accessRecorder{ResponseWriter: w}
+	w = recorder
+	entry := &accessEntry{start: time.Now()}
+	defer b.finishRequest(r, recorder, entry)
+
+	// The request span continues the trace of the client, if it sent a traceparent
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "HandleRequest",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("priority", priority.String()),
+		))
+	defer span.End()
 
 	// Increment total requests counter
 	prometheus.TotalRequests.Inc()
 
+	// Wait for an admission slot, lower priorities are shed first when overloaded
+	if b.Admission != nil {
+		if err := b.Admission.Acquire(ctx, priority); err != nil {
+			if err == ErrShed {
+				http.Error(w, "Load balancer overloaded, try again later", http.StatusTooManyRequests)
+				prometheus.TotalRateLimitHits.Inc()
+				prometheus.PriorityRateLimitHits.WithLabelValues(priority.String()).Inc()
+			}
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+		defer b.Admission.Release()
+	}
+
+	// Read the body beforehand, so that the request can be retried on another node
+	var body []byte
+	if b.ReverseProxy && r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_BYTES)); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("Request body too large (more than %d bytes)", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				span.SetStatus(codes.Error, "request body too large")
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			span.SetStatus(codes.Error, "failed to read request body")
+			return
+		}
+	}
+
+	method := jsonRPCMethod(body)
+	entry.method = method
+	entry.methods = jsonRPCMethods(body)
+	span.SetAttributes(attribute.String("rpc.method", method))
+
 	// Try each node in a loop
 	i := 0
+	attempt := 0
 	for {
+		// The client went away (during a previous attempt), the next nodes must not be tried for nothing
+		if r.Context().Err() != nil {
+			recorder.status = statusClientClosedRequest
+			span.SetStatus(codes.Error, "request canceled by the client")
+			return
+		}
+
 		// Get next node from the server manager (round-robin), and get next if rate-limited
 		node := b.ServerManager.getNextNode()
 		if node == nil {
 			http.Error(w, "No active RPC nodes available", http.StatusServiceUnavailable)
+			span.SetStatus(codes.Error, "no active node")
 			return
 		}
 		
@@ -125,9 +291,18 @@ func (b *Balancer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 			// (e.g., all are rate-limited), return an HTTP 429 or 503
 			http.Error(w, "All RPC nodes are busy at the moment", http.StatusTooManyRequests)
 			prometheus.TotalRateLimitHits.Inc()
+			prometheus.PriorityRateLimitHits.WithLabelValues(priority.String()).Inc()
+			span.SetStatus(codes.Error, "all nodes are busy")
 			return
 		}
 		i++
+
+		// The node asked us to slow down (429), skip it until its back-off expires
+		if node.backoff.Paused() {
+			prometheus.RateLimitHits.WithLabelValues(node.URL).Inc()
+			continue
+		}
+		node.restoreRateLimit()
 	
 		if node.limiter.Allow() {
 			// Increment per-node request counter
@@ -147,12 +322,20 @@ func (b *Balancer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 
 			
 			if !b.ReverseProxy {
+				entry.node = node
 				b.makeRedirect(baseURL, w, r, node)	
 				return
 			}
 
 			// Proxy this request to node.URL
-			if b.makeRequest(ctx, baseURL, w, r, node) {
+			attempt++
+			entry.attempts = attempt
+			attemptStart := time.Now()
+			served := b.makeRequest(ctx, baseURL, w, r, body, node, method, attempt-1)
+			entry.upstream += time.Since(attemptStart)
+			if served {
+				entry.node = node
+				span.SetAttributes(attribute.Int("node.id", node.ID), attribute.Int("attempts", attempt))
 				return
 			}
 
@@ -163,6 +346,23 @@ func (b *Balancer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// finishRequest records the metrics of a served request, and writes its access log
+func (b *Balancer) finishRequest(r *http.Request, w *accessRecorder, entry *accessEntry) {
+	method := prometheus.MethodLabel(entry.method)
+	key := APIKeyIDFromContext(r.Context())
+
+	prometheus.MethodRequests.WithLabelValues(method, key, prometheus.StatusClass(w.statusCode())).Inc()
+	duration := time.Since(entry.start)
+	prometheus.MethodLatency.WithLabelValues(method, key).Observe(duration.Seconds())
+
+	// Overhead of the balancer: everything but the time spent waiting for the nodes
+	prometheus.BalancerOverhead.Observe(max(duration-entry.upstream, 0).Seconds())
+
+	if b.AccessLog != nil {
+		b.AccessLog.log(r, w, entry)
+	}
+}
+
 func (b *Balancer) HandleSetInactiveNode(w http.ResponseWriter, r *http.Request) {
 	nodeIDStr := r.URL.Query().Get("node_id")
 
@@ -177,14 +377,11 @@ func (b *Balancer) HandleSetInactiveNode(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	node := b.ServerManager.cache.HeadElement()
-	for node.Value.ID != nodeID  {
-		node = node.Next
-	}
+	node := b.ServerManager.getNode(nodeID)
 	if node == nil {
 		http.Error(w, "Node not found", http.StatusNotFound)
 		return
 	}
-	b.ServerManager.setServerActive(node.Value.RPCServer, false)
+	b.ServerManager.setServerHealth(node.RPCServer, HealthUnhealthy, "403 Forbidden reported by a client", ActorClient)
 	w.WriteHeader(http.StatusOK)
 }
\ No newline at end of file
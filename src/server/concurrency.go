@@ -0,0 +1,134 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Adaptive concurrency limiting parameters (AIMD, see Netflix concurrency-limits)
+var (
+	// Initial number of concurrent requests allowed to a node, before anything has been learned
+	CONCURRENCY_INITIAL_LIMIT float64 = 20
+	// Lowest limit a node can be brought down to
+	CONCURRENCY_MIN_LIMIT float64 = 1
+	// Multiplicative decrease applied on errors or when the latency degrades
+	CONCURRENCY_BACKOFF_RATIO float64 = 0.9
+	// A request is considered slow (congestion signal) when its latency exceeds this factor of the lowest latency observed
+	CONCURRENCY_LATENCY_TOLERANCE float64 = 2.0
+	// Window after which the lowest latency is re-learned, so that a permanent latency change is eventually accepted
+	CONCURRENCY_MIN_LATENCY_WINDOW time.Duration = time.Minute
+)
+
+// concurrencyLimiter learns how many concurrent requests a node can handle from the latency and errors of its responses.
+// The limit increases by one on each successful and fast response (while the node is actually being used), and decreases multiplicatively on errors or slow responses.
+// The rate limit of the node (database) is a hard ceiling.
+type concurrencyLimiter struct {
+	mutex    sync.Mutex
+	limit    float64
+	maxLimit float64
+	inFlight int
+
+	// Lowest latency observed over the previous and current windows
+	minLatency    time.Duration
+	windowMin     time.Duration
+	windowStarted time.Time
+}
+
+func newConcurrencyLimiter(maxLimit int) *concurrencyLimiter {
+	max := math.Max(float64(maxLimit), CONCURRENCY_MIN_LIMIT)
+
+	return &concurrencyLimiter{
+		limit:         math.Min(CONCURRENCY_INITIAL_LIMIT, max),
+		maxLimit:      max,
+		windowStarted: time.Now(),
+	}
+}
+
+// Acquire reserves a slot for a request, returns false if the node is at its concurrency limit
+func (c *concurrencyLimiter) Acquire() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.inFlight >= int(c.limit) {
+		return false
+	}
+	c.inFlight++
+	return true
+}
+
+// Release frees the slot of a request and updates the limit with its outcome. dropped is true when the request failed because of the node (network error, 5xx...)
+func (c *concurrencyLimiter) Release(latency time.Duration, dropped bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	inFlight := c.inFlight
+	c.inFlight--
+
+	if dropped {
+		c.decrease()
+		return
+	}
+
+	c.observeLatency(latency)
+
+	if c.minLatency > 0 && float64(latency) > CONCURRENCY_LATENCY_TOLERANCE*float64(c.minLatency) {
+		c.decrease()
+		return
+	}
+
+	// Only grow the limit when it is actually used, otherwise an idle node would end up with an unbounded (untested) limit
+	if float64(inFlight)*2 >= c.limit {
+		c.limit = math.Min(c.limit+1, c.maxLimit)
+	}
+}
+
+// Cancel frees the slot of a request abandoned by the client, its outcome says nothing about the node
+func (c *concurrencyLimiter) Cancel() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inFlight--
+}
+
+// SetMaxLimit changes the hard ceiling of the limit (when the rate limit of the node is edited)
+func (c *concurrencyLimiter) SetMaxLimit(maxLimit int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.maxLimit = math.Max(float64(maxLimit), CONCURRENCY_MIN_LIMIT)
+	c.limit = math.Min(c.limit, c.maxLimit)
+}
+
+// Limit returns the current learned limit
+func (c *concurrencyLimiter) Limit() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int(c.limit)
+}
+
+// InFlight returns the number of requests currently sent to the node
+func (c *concurrencyLimiter) InFlight() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inFlight
+}
+
+func (c *concurrencyLimiter) decrease() {
+	c.limit = math.Max(c.limit*CONCURRENCY_BACKOFF_RATIO, CONCURRENCY_MIN_LIMIT)
+}
+
+// observeLatency keeps track of the lowest latency, over a sliding window of two periods
+func (c *concurrencyLimiter) observeLatency(latency time.Duration) {
+	if time.Since(c.windowStarted) > CONCURRENCY_MIN_LATENCY_WINDOW {
+		c.minLatency = c.windowMin
+		c.windowMin = 0
+		c.windowStarted = time.Now()
+	}
+
+	if c.windowMin == 0 || latency < c.windowMin {
+		c.windowMin = latency
+	}
+	if c.minLatency == 0 || latency < c.minLatency {
+		c.minLatency = latency
+	}
+}
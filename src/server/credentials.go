@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Valid names of the headers (RFC 9110 tokens)
+var headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// ServerAuth holds the credentials sent to a node (paid providers), kept out of its URL so that they are never displayed.
+// The values are redacted in the responses of the admin API, and encrypted in the database
+type ServerAuth struct {
+	// Header set on the requests, eg "x-api-key"
+	HeaderName  string `json:"header_name,omitempty"`
+	HeaderValue string `json:"header_value,omitempty"`
+	// Query parameter added to the requests, eg "apikey"
+	QueryParam string `json:"query_param,omitempty"`
+	QueryValue string `json:"query_value,omitempty"`
+	// HTTP basic authentication
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// isZero returns true if no credentials are configured
+func (a *ServerAuth) isZero() bool {
+	return a == nil || *a == ServerAuth{}
+}
+
+// equal returns true if both credentials are the same
+func (a *ServerAuth) equal(other *ServerAuth) bool {
+	if a.isZero() || other.isZero() {
+		return a.isZero() == other.isZero()
+	}
+	return *a == *other
+}
+
+// validate returns why the credentials cannot be sent, or nil
+func (a *ServerAuth) validate() error {
+	if a.isZero() {
+		return nil
+	}
+
+	if (a.HeaderName == "") != (a.HeaderValue == "") {
+		return fmt.Errorf("auth header_name and header_value must be set together")
+	}
+	if a.HeaderName != "" && !headerNameRegexp.MatchString(a.HeaderName) {
+		return fmt.Errorf("invalid auth header_name: %s", a.HeaderName)
+	}
+	if (a.QueryParam == "") != (a.QueryValue == "") {
+		return fmt.Errorf("auth query_param and query_value must be set together")
+	}
+	if a.Username == "" && a.Password != "" {
+		return fmt.Errorf("auth username is required with a password")
+	}
+	if strings.Contains(a.Username, ":") {
+		return fmt.Errorf("auth username cannot contain ':'")
+	}
+
+	return nil
+}
+
+// keepSecrets replaces the redacted values (sent back by the admin API clients) with the stored ones
+func (a *ServerAuth) keepSecrets(stored *ServerAuth) error {
+	if stored == nil {
+		stored = &ServerAuth{}
+	}
+
+	secrets := []struct {
+		name   string
+		value  *string
+		stored string
+	}{
+		{"header_value", &a.HeaderValue, stored.HeaderValue},
+		{"query_value", &a.QueryValue, stored.QueryValue},
+		{"password", &a.Password, stored.Password},
+	}
+	for _, secret := range secrets {
+		if *secret.value != REDACTED {
+			continue
+		}
+		if secret.stored == "" {
+			return fmt.Errorf("auth %s is required", secret.name)
+		}
+		*secret.value = secret.stored
+	}
+
+	return nil
+}
+
+// redacted returns a copy of the credentials without their values, to be displayed (the names are kept)
+func (a *ServerAuth) redacted() *ServerAuth {
+	if a == nil {
+		return nil
+	}
+
+	copied := *a
+	for _, value := range []*string{&copied.HeaderValue, &copied.QueryValue, &copied.Password} {
+		if *value != "" {
+			*value = REDACTED
+		}
+	}
+	return &copied
+}
+
+// redacted returns a copy of the server without its secrets, to be displayed
+func (server *RPCServer) redacted() *RPCServer {
+	copied := *server
+	copied.TLS = server.TLS.redacted()
+	copied.Auth = server.Auth.redacted()
+	return &copied
+}
+
+// redactServers returns copies of the servers without their secrets, to be displayed
+func redactServers(servers []*RPCServer) []*RPCServer {
+	redacted := make([]*RPCServer, 0, len(servers))
+	for _, server := range servers {
+		redacted = append(redacted, server.redacted())
+	}
+	return redacted
+}
+
+// apply adds the credentials to a request sent to the node
+func (a *ServerAuth) apply(req *http.Request) {
+	if a.isZero() {
+		return
+	}
+
+	if a.HeaderName != "" {
+		req.Header.Set(a.HeaderName, a.HeaderValue)
+	}
+	if a.QueryParam != "" {
+		query := req.URL.Query()
+		query.Set(a.QueryParam, a.QueryValue)
+		req.URL.RawQuery = query.Encode()
+	}
+	if a.Username != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+}
+
+// redactError removes the query value from the URL of a request error, before it is logged or recorded (health reason)
+func (a *ServerAuth) redactError(err error) error {
+	var urlErr *url.Error
+	if a == nil || a.QueryValue == "" || !errors.As(err, &urlErr) {
+		return err
+	}
+
+	redacted := *urlErr
+	redacted.URL = strings.ReplaceAll(urlErr.URL, url.QueryEscape(a.QueryValue), REDACTED)
+	return &redacted
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// How many events the file and dns stores keep in memory (Postgres keeps them all)
+var MAX_MEMORY_EVENTS int = 10000
+
+// Types of server events
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventHealth   = "health"
+	EventAdmin    = "admin"
+	EventDraining = "draining"
+)
+
+// Actors of the events that are not operators
+const (
+	ActorHealthCheck = "health-check"
+	ActorBalancer    = "balancer"
+	ActorClient      = "client"
+)
+
+// ServerEvent is a change of the state of a server, kept to know when and why a server went out of rotation
+type ServerEvent struct {
+	ID       int64  `json:"id"`
+	ServerID int    `json:"server_id"`
+	Type     string `json:"type"`
+	// States before and after the change (eg "healthy" -> "unhealthy"), empty when not relevant
+	FromState string `json:"from_state"`
+	ToState   string `json:"to_state"`
+	Reason    string `json:"reason"`
+	// Who made the change: health-check, balancer (403 from the node), client (reported on /inactive-server) or admin
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordEvent adds an event to the history of the server. Failures are only logged, they must not fail the change itself
+func (sm *ServerManager) recordEvent(ctx context.Context, event *ServerEvent) {
+	if err := sm.store.AddServerEvent(ctx, event); err != nil {
+		log.Printf("Error recording %s event of server %d: %v", event.Type, event.ServerID, err)
+	}
+}
+
+// memoryEvents keeps the latest events in memory, for the stores without a database
+type memoryEvents struct {
+	mutex  sync.RWMutex
+	events []*ServerEvent
+	nextID int64
+}
+
+// add appends the event, dropping the oldest ones past MAX_MEMORY_EVENTS
+func (e *memoryEvents) add(event *ServerEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.nextID++
+	event.ID = e.nextID
+	event.CreatedAt = time.Now()
+
+	copied := *event
+	e.events = append(e.events, &copied)
+	if len(e.events) > MAX_MEMORY_EVENTS {
+		e.events = e.events[len(e.events)-MAX_MEMORY_EVENTS:]
+	}
+}
+
+// get returns the latest events of a server, most recent first
+func (e *memoryEvents) get(serverID int, limit int) []*ServerEvent {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	var events []*ServerEvent
+	for i := len(e.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if e.events[i].ServerID == serverID {
+			copied := *e.events[i]
+			events = append(events, &copied)
+		}
+	}
+
+	return events
+}
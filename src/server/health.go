@@ -64,9 +64,9 @@ func (c *HealthConfig) Validate() {
     }
 }
 
-func loadHealthConfig() HealthConfig {
+func loadHealthConfig(path string) HealthConfig {
 	// Read the configuration file
-	data, err := os.ReadFile("config.json")
+	data, err := os.ReadFile(path)
 	if err != nil {
 		log.Fatalf("Error reading config file: %v", err)
 	}
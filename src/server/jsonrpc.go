@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// jsonRPCRequest is the part of a JSON-RPC request read by the balancer
+type jsonRPCRequest struct {
+	Method string `json:"method"`
+}
+
+// jsonRPCMethod returns the method of a JSON-RPC request, "batch" for a batch request, or "" if the body is not a JSON-RPC request
+func jsonRPCMethod(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return ""
+	}
+
+	if body[0] == '[' {
+		return "batch"
+	}
+
+	var request jsonRPCRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return ""
+	}
+	return request.Method
+}
+
+// jsonRPCMethods returns the methods of a JSON-RPC request (each request of a batch), or nil if the body is not a JSON-RPC request
+func jsonRPCMethods(body []byte) []string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+
+	if body[0] != '[' {
+		if method := jsonRPCMethod(body); method != "" {
+			return []string{method}
+		}
+		return nil
+	}
+
+	var requests []jsonRPCRequest
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return nil
+	}
+
+	methods := make([]string, 0, len(requests))
+	for _, request := range requests {
+		methods = append(methods, request.Method)
+	}
+	return methods
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ListenConfig configures the HTTP server of the load balancer
+type ListenConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// TLS is terminated by the load balancer when both files are set (reloaded on SIGHUP)
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTP/2 over TLS (negotiated with ALPN), and over cleartext connections (h2c, eg behind a proxy speaking HTTP/2)
+	HTTP2 bool
+	H2C   bool
+}
+
+// TLS returns true if the load balancer terminates TLS
+func (c ListenConfig) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// CertificateReloader serves the certificate of the TLS files, reloaded on SIGHUP (eg after a renewal by Certbot) without dropping the connections
+type CertificateReloader struct {
+	mutex       sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+}
+
+// NewCertificateReloader loads the certificate of the TLS files
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	c := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load reads the certificate and key files, the previous certificate is kept if they are invalid
+func (c *CertificateReloader) Load() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// getCertificate is the tls.Config.GetCertificate callback
+func (c *CertificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.certificate, nil
+}
+
+// ReloadOnSIGHUP reloads the certificate whenever the process receives SIGHUP, until stop is closed
+func (c *CertificateReloader) ReloadOnSIGHUP(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := c.Load(); err != nil {
+				log.Printf("Error reloading the TLS certificate, keeping the previous one: %v\n", err)
+				continue
+			}
+			log.Printf("TLS certificate reloaded from %s\n", c.certFile)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// NewHTTPServer creates the HTTP server of the load balancer. The certificate reloader is nil without TLS
+func NewHTTPServer(config ListenConfig, handler http.Handler) (*http.Server, *CertificateReloader, error) {
+	srv := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+
+	if !config.TLS() {
+		if config.H2C {
+			srv.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: config.IdleTimeout})
+		}
+		return srv, nil, nil
+	}
+
+	certificates, err := NewCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.getCertificate,
+	}
+
+	if config.HTTP2 {
+		if err := http2.ConfigureServer(srv, &http2.Server{IdleTimeout: config.IdleTimeout}); err != nil {
+			return nil, nil, fmt.Errorf("failed to configure HTTP/2: %v", err)
+		}
+	} else {
+		// A non-nil map disables the automatic HTTP/2 support
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	return srv, certificates, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel notified by the servers table triggers (see src/server/migrations/002_servers_notify.sql)
+const SERVERS_CHANNEL = "servers_changed"
+
+// Notifications received within this delay are applied at once (eg a script editing several servers)
+var NOTIFY_DEBOUNCE time.Duration = 100 * time.Millisecond
+
+// serverChange is the payload of a servers table notification
+type serverChange struct {
+	Operation string `json:"op"`
+	ID        int    `json:"id"`
+}
+
+// Watch listens to the notifications of the servers table (LISTEN/NOTIFY), and calls onChange for each change (or burst of changes) until the context is done
+func (s *postgresStore) Watch(ctx context.Context, onChange func()) {
+	listener := pq.NewListener(s.postgresURL, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Servers listener error: %v", err)
+		}
+	})
+
+	if err := listener.Listen(SERVERS_CHANNEL); err != nil {
+		log.Printf("Failed to listen to %s, changes will only be applied by the cache refresh: %v", SERVERS_CHANNEL, err)
+		listener.Close()
+		return
+	}
+	defer listener.Close()
+
+	// Regularly check the connection, the listener reconnects by itself if it has been lost
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			// A nil notification means the connection has been re-established, notifications may have been missed in the meantime
+			if notification == nil {
+				log.Println("Servers listener reconnected, reloading servers")
+			} else {
+				logServerChange(notification)
+			}
+
+			drainNotifications(listener)
+			onChange()
+
+		case <-ping.C:
+			go listener.Ping()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drainNotifications waits for the notifications following the first one, so that a burst of changes only reloads the servers once
+func drainNotifications(listener *pq.Listener) {
+	timer := time.NewTimer(NOTIFY_DEBOUNCE)
+	defer timer.Stop()
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			if notification != nil {
+				logServerChange(notification)
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func logServerChange(notification *pq.Notification) {
+	var change serverChange
+	if err := json.Unmarshal([]byte(notification.Extra), &change); err != nil {
+		log.Printf("Invalid servers notification %q: %v", notification.Extra, err)
+		return
+	}
+	log.Printf("Server %d changed (%s)", change.ID, change.Operation)
+}
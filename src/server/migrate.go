@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations of the loadbalancer schema, applied in order of version (the number prefixing the file name).
+// Databases created by the former db/init.sql have no migrations table, so the migrations must be safe to run again on them (IF NOT EXISTS, ...)
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Key of the advisory lock held while migrating, so that replicas starting together apply the migrations once
+var MIGRATIONS_LOCK_ID int64 = 7236401
+
+// Migration is a versioned change of the schema
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrate connects to the database and applies the pending migrations (or only lists them if dryRun). Returns the pending migrations
+func Migrate(ctx context.Context, postgresURL string, dryRun bool) ([]Migration, error) {
+	db, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	defer db.Close()
+
+	return migrate(ctx, db, dryRun)
+}
+
+// migrate applies the pending migrations, each in its own transaction, while holding the advisory lock
+func migrate(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// The advisory lock belongs to the session, so everything runs on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	defer conn.Close()
+
+	if !dryRun {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", MIGRATIONS_LOCK_ID); err != nil {
+			return nil, fmt.Errorf("failed to lock migrations: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", MIGRATIONS_LOCK_ID)
+
+		query := `
+			CREATE SCHEMA IF NOT EXISTS loadbalancer;
+
+			CREATE TABLE IF NOT EXISTS loadbalancer.schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name VARCHAR(255) NOT NULL,
+				applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+		`
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create migrations table: %v", err)
+		}
+	}
+
+	// Read after taking the lock, another replica may just have applied the migrations
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	if dryRun {
+		return pending, nil
+	}
+
+	for _, migration := range pending {
+		log.Printf("Applying migration %03d_%s\n", migration.Version, migration.Name)
+
+		if err := applyMigration(ctx, conn, migration); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+// applyMigration runs the migration and records it, in a single transaction
+func applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to apply migration %03d_%s: %v", migration.Version, migration.Name, err)
+	}
+	defer tx.Rollback()
+
+	// Without arguments, the file is sent as a simple query, so it can hold several statements
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return fmt.Errorf("failed to apply migration %03d_%s: %v", migration.Version, migration.Name, err)
+	}
+
+	query := `
+		INSERT INTO loadbalancer.schema_migrations (version, name)
+		VALUES ($1, $2)
+	`
+	if _, err := tx.ExecContext(ctx, query, migration.Version, migration.Name); err != nil {
+		return fmt.Errorf("failed to record migration %03d_%s: %v", migration.Version, migration.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+// appliedMigrations returns the versions already applied (none if the migrations table does not exist yet)
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('loadbalancer.schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to query migrations: %v", err)
+	}
+
+	applied := make(map[int]bool)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM loadbalancer.schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query migrations: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration row: %v", err)
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// loadMigrations reads the embedded migrations ("<version>_<name>.sql"), sorted by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	var migrations []Migration
+	versions := make(map[int]string)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		versionStr, name, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !found || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name: %s. Must be '<version>_<name>.sql'", entry.Name())
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, entry.Name())
+		}
+		versions[version] = entry.Name()
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", entry.Name(), err)
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
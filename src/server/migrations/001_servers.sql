@@ -1,4 +1,4 @@
--- servers.sql
+-- Servers the load balancer routes to
 
 CREATE SCHEMA IF NOT EXISTS loadbalancer;
 
@@ -11,6 +11,3 @@ CREATE TABLE IF NOT EXISTS loadbalancer.servers (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
-
--- Add index on is_active for faster queries
-CREATE INDEX idx_servers_is_active ON servers(is_active);
\ No newline at end of file
@@ -0,0 +1,17 @@
+-- Notify the load balancers of any change to the servers, so that it is applied right away
+
+CREATE OR REPLACE FUNCTION loadbalancer.notify_servers_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify(
+        'servers_changed',
+        json_build_object('op', TG_OP, 'id', COALESCE(NEW.id, OLD.id))::text
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS servers_changed ON loadbalancer.servers;
+
+CREATE TRIGGER servers_changed
+    AFTER INSERT OR UPDATE OR DELETE ON loadbalancer.servers
+    FOR EACH ROW EXECUTE FUNCTION loadbalancer.notify_servers_changed();
@@ -0,0 +1,3 @@
+-- Servers can be drained (taken out of rotation for maintenance)
+
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS draining BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,28 @@
+-- Separate the admin state (operator decision) from the health state (observed by the balancer)
+
+ALTER TABLE loadbalancer.servers
+    ADD COLUMN IF NOT EXISTS admin_state VARCHAR(16) NOT NULL DEFAULT 'enabled' CHECK (admin_state IN ('enabled', 'disabled')),
+    ADD COLUMN IF NOT EXISTS admin_reason TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS admin_changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS health_state VARCHAR(16) NOT NULL DEFAULT 'unknown' CHECK (health_state IN ('unknown', 'healthy', 'unhealthy')),
+    ADD COLUMN IF NOT EXISTS health_reason TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS health_changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+-- is_active was only set to false by the balancer (403 responses), so inactive servers become unhealthy
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'loadbalancer' AND table_name = 'servers' AND column_name = 'is_active'
+    ) THEN
+        UPDATE loadbalancer.servers
+        SET health_state = CASE WHEN is_active = false THEN 'unhealthy' ELSE 'healthy' END,
+            health_reason = CASE WHEN is_active = false THEN 'migrated from is_active = false' ELSE 'migrated from is_active = true' END;
+    END IF;
+END
+$$;
+
+DROP INDEX IF EXISTS loadbalancer.idx_servers_is_active;
+ALTER TABLE loadbalancer.servers DROP COLUMN IF EXISTS is_active;
+
+CREATE INDEX IF NOT EXISTS idx_servers_states ON loadbalancer.servers(admin_state, health_state);
@@ -0,0 +1,14 @@
+-- History of the state changes of the servers (health, admin actions, draining), kept after a server is deleted
+
+CREATE TABLE IF NOT EXISTS loadbalancer.server_events (
+    id BIGSERIAL PRIMARY KEY,
+    server_id INTEGER NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    from_state VARCHAR(16) NOT NULL DEFAULT '',
+    to_state VARCHAR(16) NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_server_events_server_id ON loadbalancer.server_events(server_id, created_at DESC);
@@ -0,0 +1,18 @@
+-- Daily SLA summaries of the servers (requests and health probes outcomes, latency), kept after a server is deleted
+
+CREATE TABLE IF NOT EXISTS loadbalancer.server_sla_daily (
+    server_id INTEGER NOT NULL,
+    day DATE NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    rate_limited BIGINT NOT NULL DEFAULT 0,
+    probes BIGINT NOT NULL DEFAULT 0,
+    probe_failures BIGINT NOT NULL DEFAULT 0,
+    -- Counts of the latency buckets of the balancer (SLA_LATENCY_BUCKETS)
+    latency_buckets BIGINT[] NOT NULL DEFAULT '{}',
+    latency_p50_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    latency_p95_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    latency_p99_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (server_id, day)
+);
@@ -0,0 +1,7 @@
+-- TLS configuration of the connections to the servers: private CA, client certificate (mTLS), SNI override
+
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS tls_ca_cert TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS tls_client_cert TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS tls_client_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS tls_server_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS tls_insecure_skip_verify BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+-- Credentials sent to the servers (header, query parameter, basic auth), kept out of their URL.
+-- The values are encrypted by the load balancer (SERVER_SECRETS_KEY), and so is the TLS client key from now on
+
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_header_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_header_value TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_query_param TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_query_value TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_username TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.servers ADD COLUMN IF NOT EXISTS auth_password TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- Each replica of the load balancer saves its own daily SLA summaries (they are summed on read), instead of replacing the ones of the others
+
+ALTER TABLE loadbalancer.server_sla_daily ADD COLUMN IF NOT EXISTS replica TEXT NOT NULL DEFAULT '';
+ALTER TABLE loadbalancer.server_sla_daily DROP CONSTRAINT IF EXISTS server_sla_daily_pkey;
+ALTER TABLE loadbalancer.server_sla_daily ADD PRIMARY KEY (server_id, day, replica);
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Priority is the scheduling class of a client request. When the balancer is saturated, higher priorities are served first and lower priorities are shed first
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// Number of priority classes (used to size the admission queues)
+const numPriorities = int(PriorityHigh) + 1
+
+// PRIORITY_WEIGHTS is the share of admissions given to each priority class when requests are waiting for a slot (low, normal, high)
+var PRIORITY_WEIGHTS = [numPriorities]int{1, 4, 16}
+
+// PRIORITY_HEADER lets a client lower the priority of a request below the one of its API key
+var PRIORITY_HEADER = "X-Priority"
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// ParsePriority parses a priority name (low, normal or high)
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("invalid priority: %q. Must be one of: low, normal, high", s)
+}
+
+type priorityContextKey struct{}
+
+// WithPriority returns a copy of the context carrying the priority of the request
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, p)
+}
+
+// PriorityFromContext returns the priority of the request, or PriorityNormal if none was set
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityContextKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
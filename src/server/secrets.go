@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Prefixes of the encrypted values in the database (the values without one were written before the encryption, or without key).
+// The v1 values only authenticate their column, the v2 ones their column and server
+const (
+	encryptedPrefixV1 = "enc:v1:"
+	encryptedPrefix   = "enc:v2:"
+)
+
+// secretBox encrypts the secrets of the servers (credentials, TLS client keys) stored in the database, with AES-256-GCM
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+// newSecretBox creates the box of a 32 bytes key, nil without key (the secrets are stored in plain text)
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid secrets key: must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secrets cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secrets cipher: %v", err)
+	}
+
+	return &secretBox{aead: aead}, nil
+}
+
+// seal encrypts the value of a column of a server (empty values are kept empty, and values are kept in plain text without key).
+// The column and the server id are authenticated, so a value cannot be moved to another column or server
+func (b *secretBox) seal(column string, serverID int, value string) (string, error) {
+	if value == "" || b == nil {
+		return value, nil
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(value), secretData(column, serverID))
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the value of a column of a server, the values written in plain text are returned as is
+func (b *secretBox) open(column string, serverID int, value string) (string, error) {
+	prefix, data := encryptedPrefix, secretData(column, serverID)
+	if strings.HasPrefix(value, encryptedPrefixV1) {
+		prefix, data = encryptedPrefixV1, []byte(column)
+	}
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	if b == nil {
+		return "", fmt.Errorf("failed to decrypt %s: SERVER_SECRETS_KEY is not set", column)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", fmt.Errorf("failed to decrypt %s: invalid value", column)
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", column, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// secretData returns the associated data of a secret: its column and server
+func secretData(column string, serverID int) []byte {
+	return []byte(fmt.Sprintf("%s:%d", column, serverID))
+}
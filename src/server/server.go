@@ -2,9 +2,9 @@ package server
 
 import (
 	"load-balancer/src/queue"
+	"load-balancer/src/prometheus"
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -18,7 +18,21 @@ import (
 
 // Configuration struct for the application
 type Config struct {
+	// Where the servers are stored: "postgres" (default), "file" or "dns"
+	Store       string
+	// Store used instead of the one selected by Store when set (embedding the balancer, tests)
+	ServerStore ServerStore
 	PostgresURL string
+	// Servers file (JSON or YAML) when using the file store
+	ServersFile string
+	// Discovery of the servers when using the dns store
+	DNS         DNSConfig
+	// Key encrypting the secrets of the servers in the database (32 bytes)
+	SecretsKey  []byte
+	// Health check configuration (config.json by default)
+	HealthConfigFile string
+	// Connections to the nodes
+	Transport   TransportConfig
 	// RedisURL    string
 	CacheSize   int
 	CacheTTL    time.Duration
@@ -30,7 +44,22 @@ type RPCServer struct {
 	URL        string    `json:"url"`
 	RateLimit  int       `json:"rate_limit"`
 	BurstLimit int       `json:"burst_limit"`
+	// Operator decision (enabled/disabled), never changed by the health check
+	AdminState      AdminState  `json:"admin_state"`
+	AdminReason     string      `json:"admin_reason"`
+	AdminChangedAt  time.Time   `json:"admin_changed_at"`
+	// Health observed by the balancer (healthy/unhealthy/unknown)
+	HealthState     HealthState `json:"health_state"`
+	HealthReason    string      `json:"health_reason"`
+	HealthChangedAt time.Time   `json:"health_changed_at"`
+	// IsActive is true when requests can be routed to the server (enabled and not unhealthy), it is computed from the states
 	IsActive   bool      `json:"is_active"`
+	// Draining servers are taken out of rotation for maintenance (no new requests), without being considered unhealthy
+	Draining   bool      `json:"draining"`
+	// TLS configuration of the connections to the server (private CA, mTLS), nil for the defaults
+	TLS        *ServerTLS `json:"tls,omitempty"`
+	// Credentials sent to the server (header, query parameter, basic auth), nil for none
+	Auth       *ServerAuth `json:"auth,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
 }
@@ -39,37 +68,92 @@ type RPCServer struct {
 type Node struct {
 	*RPCServer
 	limiter *rate.Limiter
+	// Concurrency limit learned from the latency and errors of the node (the rate limit is a hard ceiling)
+	concurrency *concurrencyLimiter
+	// Pauses the node when its provider answers 429
+	backoff *backoff
+	// Client of the requests proxied to the node, with its own connection pool and the TLS configuration of the server
+	client *http.Client
+	conns  *connPool
+}
+
+// newNode creates the runtime information of a server
+func newNode(server *RPCServer, config TransportConfig) *Node {
+	conns := getConnPool(server.URL)
+	transport, err := newTransport(server, config, conns)
+	if err != nil {
+		// Validated when the server is saved, the requests fail if the node requires the configuration
+		log.Printf("Invalid TLS configuration of server %d, using the defaults: %v", server.ID, err)
+		transport, _ = newTransport(&RPCServer{URL: server.URL}, config, conns)
+	}
+
+	return &Node{
+		RPCServer:   server,
+		limiter:     rate.NewLimiter(rate.Limit(server.RateLimit), server.BurstLimit),
+		concurrency: newConcurrencyLimiter(server.RateLimit),
+		backoff:     &backoff{},
+		client:      &http.Client{Transport: transport},
+		conns:       conns,
+	}
+}
+
+
+// state returns the routing state of the node: active, draining (taken out of rotation, in-flight requests remaining) or drained
+func (node *Node) state() string {
+	if !node.Draining {
+		return "active"
+	}
+	if node.concurrency.InFlight() > 0 {
+		return "draining"
+	}
+	return "drained"
 }
 
 
 // ServerManager handles server management and caching
 type ServerManager struct {
-	db          *sql.DB
+	store       ServerStore
 	// redis       *redis.Client
 	cache       *queue.RingQueue[*Node]
+	// All the nodes of the active servers, including the draining ones (which are not in the weighted queue)
+	nodes       []*Node
 	cacheMutex  sync.RWMutex
 	cacheSize   int
 	cacheTTL    time.Duration
 	refreshTick time.Duration
-}
-
-var healthConfig HealthConfig
-
-func init() {
-	healthConfig = loadHealthConfig()
+	// Availability, error rate and latency of the nodes, for the SLA report
+	sla         *slaTracker
+	// Last health probe of each server, for the stats
+	healthChecks healthChecks
+	// URLs of the servers reported in the per-node metrics, their series are deleted once the server is deleted
+	metricURLs  map[string]bool
+	// Connections to the nodes (pool, timeouts, HTTP/2)
+	transport TransportConfig
+	// Interval and request of the health checks
+	healthConfig HealthConfig
+	// Stops the background routines (cache refresh, store watch, health check, SLA flush)
+	cancel      context.CancelFunc
+	routines    sync.WaitGroup
 }
 
 // NewServerManager creates a new server manager instance
 func NewServerManager(config Config) (*ServerManager, error) {
-	// Connect to PostgreSQL
-	db, err := sql.Open("postgres", config.PostgresURL)
+	if config.HealthConfigFile == "" {
+		config.HealthConfigFile = "config.json"
+	}
+	healthConfig := loadHealthConfig(config.HealthConfigFile)
+
+	store, err := newServerStore(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+		return nil, err
 	}
 
-	// Test the connection
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping postgres: %v", err)
+	// Apply the pending migrations of the schema before reading the servers (only Postgres has a schema)
+	if postgres, ok := store.(*postgresStore); ok {
+		if _, err := migrate(context.Background(), postgres.db, false); err != nil {
+			store.Close()
+			return nil, err
+		}
 	}
 
 	// // Connect to Redis
@@ -87,78 +171,165 @@ func NewServerManager(config Config) (*ServerManager, error) {
 
 
 	sm := &ServerManager{
-		db:          db,
+		store:       store,
 		// redis:       rdb,
 		cache:       nil,
 		cacheSize:   config.CacheSize,
 		cacheTTL:    config.CacheTTL,
 		refreshTick: 15 * time.Minute, // Refresh cache every 15 minutes
+		sla:         newSLATracker(),
+		transport:   config.Transport,
+		healthConfig: healthConfig,
 	}
 
 	// Initialize the cache
-	ctx := context.Background()
-	activeServers, err := sm.getActiveServers(ctx)
+	ctx, cancel := context.WithCancel(context.Background())
+	sm.cancel = cancel
+	activeServers, servers, err := sm.getServers(ctx)
 	if err != nil {
         log.Fatalf("failed to get active servers: %v", err)
     }
 
-	nodes := make([]*Node, 0, len(activeServers))
-	for _, server := range activeServers {
-		nodes = append(nodes, &Node{
-            RPCServer: server,
-            limiter:   rate.NewLimiter(rate.Limit(server.RateLimit), server.BurstLimit),
-        })
-	}
-
-	sm.cache = createWeightedQueue(nodes)
+	sm.cache = createWeightedQueue(nil)
+	sm.setCache(activeServers, servers)
 
 	// Start cache refresh routine
-	go sm.startCacheRefresh()
+	sm.goRoutine(func() { sm.startCacheRefresh(ctx) })
+
+	// Apply the changes made to the servers outside of the balancer as soon as they are notified
+	sm.goRoutine(func() {
+		sm.store.Watch(ctx, func() {
+			if err := sm.rebuildCache(ctx); err != nil {
+				log.Printf("Error applying servers changes: %v", err)
+			}
+		})
+	})
 
 	// Starts the health check routine
-	go sm.startHealthCheck()
+	sm.goRoutine(func() { sm.startHealthCheck(ctx) })
+
+	// Restore the SLA of the last 30 days, and save the daily rollups periodically
+	sm.loadSLA(ctx)
+	sm.goRoutine(func() { sm.startSLAFlush(ctx) })
 
 	return sm, nil
 }
 
-// startCacheRefresh periodically refreshes the cache
-func (sm *ServerManager) startCacheRefresh() {
+// goRoutine runs a background routine, waited for by Close
+func (sm *ServerManager) goRoutine(routine func()) {
+	sm.routines.Add(1)
+	go func() {
+		defer sm.routines.Done()
+		routine()
+	}()
+}
+
+// Close stops the background routines, saves the SLA, and closes the store (database connections)
+func (sm *ServerManager) Close() error {
+	sm.cancel()
+	sm.routines.Wait()
+
+	// Save the SLA of the day collected since the last flush
+	sm.flushSLA(context.Background())
+
+	return sm.store.Close()
+}
+
+// startCacheRefresh periodically refreshes the cache, until the context is done
+func (sm *ServerManager) startCacheRefresh(ctx context.Context) {
 	ticker := time.NewTicker(sm.refreshTick)
-	for range ticker.C {
-		if err := sm.refreshCache(); err != nil {
-			log.Printf("Error refreshing cache: %v", err)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := sm.refreshCache(ctx); err != nil {
+				log.Printf("Error refreshing cache: %v", err)
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
 // refreshCache updates the cache with fresh data from the database
-func (sm *ServerManager) refreshCache() error {
-	ctx := context.Background()
-	
+func (sm *ServerManager) refreshCache(ctx context.Context) error {
+
 	// Get all active servers from database
-	servers, err := sm.getActiveServers(ctx)
+	activeServers, servers, err := sm.getServers(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to refresh cache: %v", err)
 	}
 
+	// Changes are normally applied right away when notified by the store (see ServerStore.Watch), polling is a fallback in case a notification has been missed
+	sm.setCache(activeServers, servers)
 
-	// Only refresh cache if the number of servers have changed (other updates are made on cache AND database, so the only thing that can change is the number of servers)
-	if len(servers) == sm.cache.Length() {
-		return nil
+	return nil
+}
+
+// rebuildCache rebuilds the weighted queue right away from the active servers of the database (after the servers have been edited)
+func (sm *ServerManager) rebuildCache(ctx context.Context) error {
+	activeServers, servers, err := sm.getServers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild cache: %v", err)
+	}
+
+	sm.setCache(activeServers, servers)
+
+	return nil
+}
+
+// getServers retrieves the active servers (routed to), and all the servers (reported in the metrics)
+func (sm *ServerManager) getServers(ctx context.Context) ([]*RPCServer, []*RPCServer, error) {
+	activeServers, err := sm.store.GetActiveServers(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers, err := sm.store.GetServers(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	return activeServers, servers, nil
+}
+
+// setCache replaces the weighted queue with the given active servers, all the servers are given for the metrics.
+// Nodes of servers already in the cache keep their limiter state, back-off and connections. Nodes whose URL changed are recreated, since they point to another server (and so are the nodes whose TLS configuration changed, for their connections)
+func (sm *ServerManager) setCache(servers []*RPCServer, all []*RPCServer) {
+	// The previous nodes are read under the same lock, so that two concurrent rebuilds do not compare against a stale list
 	sm.cacheMutex.Lock()
 	defer sm.cacheMutex.Unlock()
 
+	existing := make(map[int]*Node)
+	for _, node := range sm.nodes {
+		existing[node.ID] = node
+	}
+
 	nodes := make([]*Node, 0, len(servers))
 
 	// Update cache with fresh data
 	for _, server := range servers {
-		node := &Node{
-			RPCServer: server,
-			limiter:   rate.NewLimiter(rate.Limit(server.RateLimit), server.BurstLimit),
+		node, ok := existing[server.ID]
+		if !ok || node.URL != server.URL || !node.TLS.equal(server.TLS) {
+			if ok {
+				node.client.CloseIdleConnections()
+			}
+			nodes = append(nodes, newNode(server, sm.transport))
+			continue
 		}
-		nodes = append(nodes, node)
+
+		if node.RateLimit != server.RateLimit {
+			node.limiter.SetLimit(rate.Limit(server.RateLimit))
+			node.concurrency.SetMaxLimit(server.RateLimit)
+		}
+		if node.BurstLimit != server.BurstLimit {
+			node.limiter.SetBurst(server.BurstLimit)
+		}
+		// The requests in flight read their node without the lock, so it is never modified: a copy sharing its state replaces it
+		updated := *node
+		updated.RPCServer = server
+		nodes = append(nodes, &updated)
 
 		// // Update Redis cache
 		// serverJSON, err := json.Marshal(server)
@@ -173,55 +344,134 @@ func (sm *ServerManager) refreshCache() error {
 		// }
 	}
 
-	sm.cache = createWeightedQueue(nodes)
+	// Draining nodes are kept (to follow their in-flight requests), but not routed to
+	routable := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if !node.Draining {
+			routable = append(routable, node)
+		}
+	}
 
-	return nil
+	sm.nodes = nodes
+	sm.cache = createWeightedQueue(routable)
+
+	sm.metricURLs = updateNodeMetrics(sm.metricURLs, nodes, all, weightedQueueSlots(sm.cache))
+
+	// The nodes that left the cache do not receive requests anymore, close their idle connections
+	for _, node := range nodes {
+		delete(existing, node.ID)
+	}
+	for _, node := range existing {
+		node.client.CloseIdleConnections()
+	}
 }
 
-// GetActiveServers retrieves all active servers from the database
-func (sm *ServerManager) getActiveServers(ctx context.Context) ([]*RPCServer, error) {
-	query := `
-		SELECT id, url, rate_limit, burst_limit, is_active, created_at, updated_at
-		FROM servers
-		WHERE is_active = true
-		ORDER BY id ASC
-	`
+// updateNodeMetrics sets the gauges of the nodes after the cache has been rebuilt. The servers out of the cache (inactive) are reported down,
+// and the series of the servers that no longer exist (deleted, or URL changed) are deleted. Returns the URLs now reported
+func updateNodeMetrics(reported map[string]bool, nodes []*Node, servers []*RPCServer, slots map[int]int) map[string]bool {
+	urls := make(map[string]bool)
+	cached := make(map[int]bool)
+
+	active := 0
+	for _, node := range nodes {
+		urls[node.URL] = true
+		cached[node.ID] = true
+
+		up := 0.0
+		if node.IsActive && !node.Draining {
+			up = 1
+			active++
+		}
+		prometheus.NodeUp.WithLabelValues(node.URL).Set(up)
+		prometheus.NodeRateLimit.WithLabelValues(node.URL).Set(float64(node.RateLimit))
+		prometheus.NodeBurstLimit.WithLabelValues(node.URL).Set(float64(node.BurstLimit))
+		prometheus.NodeQueueSlots.WithLabelValues(node.URL).Set(float64(slots[node.ID]))
+		setHealthCheckUp(node.URL, node.HealthState)
+	}
 
-	rows, err := sm.db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query active servers: %v", err)
-	}
-	defer rows.Close()
-
-	var servers []*RPCServer
-
-	// Add an index to the servers (to ensure deterministic order, since the database doesn't guarantee it)
-	for rows.Next() {
-		server := &RPCServer{}
-		err := rows.Scan(
-			&server.ID,
-			&server.URL,
-			&server.RateLimit,
-			&server.BurstLimit,
-			&server.IsActive,
-			&server.CreatedAt,
-			&server.UpdatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan server row: %v", err)
+	for _, server := range servers {
+		if cached[server.ID] {
+			continue
 		}
+		urls[server.URL] = true
 
-		servers = append(servers, server)
+		prometheus.NodeUp.WithLabelValues(server.URL).Set(0)
+		prometheus.NodeRateLimit.WithLabelValues(server.URL).Set(float64(server.RateLimit))
+		prometheus.NodeBurstLimit.WithLabelValues(server.URL).Set(float64(server.BurstLimit))
+		prometheus.NodeQueueSlots.WithLabelValues(server.URL).Set(0)
+		setHealthCheckUp(server.URL, server.HealthState)
 	}
 
-	return servers, nil
+	for url := range reported {
+		if !urls[url] {
+			forgetNodeMetrics(url)
+		}
+	}
+
+	prometheus.ActiveNodes.Set(float64(active))
+
+	return urls
 }
 
+// setHealthCheckUp reports the health of a server, as last observed by the health checks (and 403 responses). The series is absent until the health is known
+func setHealthCheckUp(url string, state HealthState) {
+	switch state {
+	case HealthHealthy:
+		prometheus.HealthCheckUp.WithLabelValues(url).Set(1)
+	case HealthUnhealthy:
+		prometheus.HealthCheckUp.WithLabelValues(url).Set(0)
+	default:
+		prometheus.HealthCheckUp.DeleteLabelValues(url)
+	}
+}
 
-func (sm *ServerManager) getNextNode() *Node {
+// recordHealthCheckMetrics counts the health check of a node, and keeps its result
+func recordHealthCheckMetrics(url string, err error) {
+	if err != nil {
+		prometheus.HealthChecks.WithLabelValues(url, "failure").Inc()
+		prometheus.HealthCheckUp.WithLabelValues(url).Set(0)
+		return
+	}
+	prometheus.HealthChecks.WithLabelValues(url, "success").Inc()
+	prometheus.HealthCheckUp.WithLabelValues(url).Set(1)
+}
+
+// forgetNodeMetrics removes the gauges of a node that no longer exists (deleted server, or URL changed)
+func forgetNodeMetrics(url string) {
+	prometheus.NodeUp.DeleteLabelValues(url)
+	prometheus.NodeRateLimit.DeleteLabelValues(url)
+	prometheus.NodeBurstLimit.DeleteLabelValues(url)
+	prometheus.NodeQueueSlots.DeleteLabelValues(url)
+	prometheus.HealthCheckUp.DeleteLabelValues(url)
+	forgetConnPool(url)
+	prometheus.UpstreamConnections.DeleteLabelValues(url, "active")
+	prometheus.UpstreamConnections.DeleteLabelValues(url, "idle")
+}
+
+// getNodes returns the nodes of the active servers (including the draining ones)
+func (sm *ServerManager) getNodes() []*Node {
 	sm.cacheMutex.RLock()
 	defer sm.cacheMutex.RUnlock()
 
+	return append([]*Node(nil), sm.nodes...)
+}
+
+// getNode returns the node of a server, or nil if it is not active
+func (sm *ServerManager) getNode(id int) *Node {
+	for _, node := range sm.getNodes() {
+		if node.ID == id {
+			return node
+		}
+	}
+	return nil
+}
+
+// getNextNode returns the next active node of the weighted queue, or nil if there is none.
+// Moving in the queue (and removing the inactive nodes) modifies it, so the write lock is required
+func (sm *ServerManager) getNextNode() *Node {
+	sm.cacheMutex.Lock()
+	defer sm.cacheMutex.Unlock()
+
 	if sm.cache.Length() == 0 {
 		return nil
 	}
@@ -246,87 +496,187 @@ func (sm *ServerManager) getNextNode() *Node {
 }
 
 
-func (sm *ServerManager) setServerActive(server *RPCServer, active bool) {
+// setServerHealth changes the health of a server (health check, 403 responses), and records the change. It never changes the admin state, so a disabled server stays disabled
+func (sm *ServerManager) setServerHealth(server *RPCServer, state HealthState, reason string, actor string) {
 	
-	// Update in-memory cache (just have to set the value of the pointer, Node refers to the RPCServer pointer, and the queue itself refers to the Node pointers), so updating the cache is easy.
-	// When a server has been set to inactive, it will be removed from the cache the next time it is accessed
+	// Update the in-memory cache right away. The requests in flight read their node without the lock, so the node is replaced by a copy with the new health (see setCache).
+	// When a server has been set to inactive, it will be removed from the weighted queue the next time it is accessed
 	sm.cacheMutex.Lock()
-	server.IsActive = active
+	current := server
+	if node := sm.findNode(server.ID); node != nil {
+		current = node.RPCServer
+	}
+	previous := current.HealthState
+	if previous == state {
+		// Already known (eg several 403 responses in a row)
+		sm.cacheMutex.Unlock()
+		return
+	}
+	updated := *current
+	updated.setHealthState(state, reason)
+	sm.replaceServer(&updated)
 	sm.cacheMutex.Unlock()
 
+	// Reported right away, even if the store cannot be updated
+	if state == HealthUnhealthy {
+		prometheus.NodeUp.WithLabelValues(server.URL).Set(0)
+	}
 
-	// // Update Redis cache
-	// serverJSON, err := json.Marshal(node.RPCServer)
-	// if err != nil {
-	// 	log.Printf("Error marshaling server %d: %v", node.ID, err)
-	// 	return
-	// }
+	log.Printf("Server %d is %s: %s", server.ID, state, reason)
+	prometheus.NodeHealthChanges.WithLabelValues(server.URL, string(state)).Inc()
 
-	// err = sm.redis.Set(ctx, fmt.Sprintf("server:%d", node.ID), serverJSON, sm.cacheTTL).Err()
+	// Set database
+	if err := sm.store.SetServerHealth(context.Background(), server.ID, state, reason); err != nil {
+		log.Printf("Error updating server %d in database: %v", server.ID, err)
+		return
+	}
 
-	// if err != nil {
-	// 	log.Printf("Error updating Redis cache for server %d: %v", node.ID, err)
-	// }
+	sm.recordEvent(context.Background(), &ServerEvent{
+		ServerID:  server.ID,
+		Type:      EventHealth,
+		FromState: string(previous),
+		ToState:   string(state),
+		Reason:    reason,
+		Actor:     actor,
+	})
+
+	// A server back to health is not in the cache anymore, add it back right away
+	// (becoming unhealthy also rebuilds it, since the store may route to other servers instead, eg backup SRV records)
+	if err := sm.rebuildCache(context.Background()); err != nil {
+		log.Printf("Error rebuilding cache: %v", err)
+	}
+}
 
-	// Set database
-	query := `
-		UPDATE servers
-		SET is_active = $1
-		WHERE id = $2
-	`
+// findNode returns the node of a server, or nil if it is not in the cache. Must be called with the cache mutex held
+func (sm *ServerManager) findNode(id int) *Node {
+	for _, node := range sm.nodes {
+		if node.ID == id {
+			return node
+		}
+	}
+	return nil
+}
 
-	_, err := sm.db.Exec(query, active, server.ID)
+// replaceServer replaces the node of a server by a copy pointing to the given server, in the nodes and in the weighted queue. Must be called with the cache mutex held
+func (sm *ServerManager) replaceServer(server *RPCServer) {
+	nodes := make([]*Node, 0, len(sm.nodes))
+	routable := make([]*Node, 0, len(sm.nodes))
+	for _, node := range sm.nodes {
+		if node.ID == server.ID {
+			updated := *node
+			updated.RPCServer = server
+			node = &updated
+		}
+		nodes = append(nodes, node)
+		if !node.Draining {
+			routable = append(routable, node)
+		}
+	}
 
-	if err != nil {
-		log.Printf("Error updating server %d in database: %v", server.ID, err)
-		return
+	sm.nodes = nodes
+	sm.cache = createWeightedQueue(routable)
+}
+
+// setServerAdminState enables or disables a server (operator decision), and records the change
+func (sm *ServerManager) setServerAdminState(ctx context.Context, server *RPCServer, state AdminState, reason string, actor string) error {
+	if err := sm.store.SetServerAdminState(ctx, server.ID, state, reason); err != nil {
+		return err
 	}
+
+	sm.recordEvent(ctx, &ServerEvent{
+		ServerID:  server.ID,
+		Type:      EventAdmin,
+		FromState: string(server.AdminState),
+		ToState:   string(state),
+		Reason:    reason,
+		Actor:     actor,
+	})
+
+	return sm.rebuildCache(ctx)
 }
 
+// setServerDraining takes a server out of rotation (draining) or puts it back, and records the change. In-flight requests to a draining server are not interrupted
+func (sm *ServerManager) setServerDraining(ctx context.Context, server *RPCServer, draining bool, actor string) error {
+	if err := sm.store.SetServerDraining(ctx, server.ID, draining); err != nil {
+		return err
+	}
 
-func (server *RPCServer) isHealthy() bool {
-	// Check if the server is healthy
-	// Since the servers are RPC servers, we can send a simple request to check if they are healthy
+	sm.recordEvent(ctx, &ServerEvent{
+		ServerID:  server.ID,
+		Type:      EventDraining,
+		FromState: drainingState(server.Draining),
+		ToState:   drainingState(draining),
+		Actor:     actor,
+	})
 
-	jsonBody, err := json.Marshal(healthConfig.HealthCheck.Request.Body)
+	return sm.rebuildCache(ctx)
+}
 
+// drainingState names the draining flag in the events
+func drainingState(draining bool) string {
+	if draining {
+		return "draining"
+	}
+	return "active"
+}
+
+// newHealthCheckRequest creates the request configured to check the health of a server (config.json), with its credentials
+func (sm *ServerManager) newHealthCheckRequest(server *RPCServer) (*http.Request, error) {
+	jsonBody, err := json.Marshal(sm.healthConfig.HealthCheck.Request.Body)
 	if err != nil {
-		log.Printf("Error marshaling health check request body: %v", err)
-        return false
+		return nil, fmt.Errorf("failed to marshal health check request body: %v", err)
 	}
-	bodyReader := bytes.NewReader(jsonBody)
 
-	req, err := http.NewRequest(healthConfig.HealthCheck.Request.Method, server.URL, bodyReader)
+	req, err := http.NewRequest(sm.healthConfig.HealthCheck.Request.Method, server.URL, bytes.NewReader(jsonBody))
 	if err != nil {
-		log.Printf("Error creating health check request: %v", err)
-		return false
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	server.Auth.apply(req)
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+	return req, nil
+}
+
+// checkHealth returns why the server is unhealthy, or nil if it is healthy
+func (sm *ServerManager) checkHealth(server *RPCServer) error {
+	// Check if the server is healthy
+	// Since the servers are RPC servers, we can send a simple request to check if they are healthy
+
+	req, err := sm.newHealthCheckRequest(server)
+	if err != nil {
+		log.Printf("Error creating health check request: %v", err)
+		return err
+	}
+
+	client, err := newServerClient(server, sm.transport, 5*time.Second)
+	if err != nil {
+		return err
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
+		// The error holds the URL of the request, with the query credentials
+		err = server.Auth.redactError(err)
 		log.Printf("Error sending health check request: %v", err)
-		return false
+		return err
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Server %d is unhealthy: %v", server.ID, resp.Status)
-		return false
+		return fmt.Errorf("status %s", resp.Status)
 	}
 
-	return true
+	return nil
 }
 
 
-func (sm *ServerManager) startHealthCheck() {
+// startHealthCheck periodically checks the health of the unhealthy servers, until the context is done
+func (sm *ServerManager) startHealthCheck(ctx context.Context) {
 	var duration time.Duration
 
-	switch healthConfig.HealthCheck.Interval.Unit {
+	switch sm.healthConfig.HealthCheck.Interval.Unit {
 	case "hour":
 		duration = time.Hour
 	case "minute":
@@ -335,50 +685,49 @@ func (sm *ServerManager) startHealthCheck() {
 		duration = time.Second
 	}
 
-	duration *= time.Duration(healthConfig.HealthCheck.Interval.Value)
+	duration *= time.Duration(sm.healthConfig.HealthCheck.Interval.Value)
 
 	// Run health check every 24hours
 	ticker := time.NewTicker(duration)
-    for range ticker.C {
-        sm.healthCheck()
-    }
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.healthCheck(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-// healthCheck periodically checks the health of inactive servers (every 24 hours) meaning it checks if the server responds to requests, and updates the database accordingly
-func (sm *ServerManager) healthCheck() {
+// healthCheck periodically checks the health of the unhealthy (and unknown) servers (every 24 hours) meaning it checks if the server responds to requests, and updates their health accordingly
+func (sm *ServerManager) healthCheck(ctx context.Context) {
 	log.Println("Starting health check routine")
 	
-	// Get all the inactive servers
-	query := `
-		SELECT * FROM servers WHERE is_active = false`
-
-	rows, err := sm.db.Query(query)
+	// Get the servers whose health is unhealthy or unknown
+	servers, err := sm.store.GetServersToCheck(ctx)
 	if err != nil {
-		log.Printf("Error querying inactive servers: %v", err)
+		log.Printf("Error querying servers to check: %v", err)
 		return
 	}
 
-	defer rows.Close()
-
-	for rows.Next() {
-		server := &RPCServer{}
-		err := rows.Scan(
-			&server.ID,
-			&server.URL,
-			&server.RateLimit,
-			&server.BurstLimit,
-			&server.IsActive,
-			&server.CreatedAt,
-			&server.UpdatedAt,
-		)
-		if err != nil {
-			log.Printf("Error scanning inactive server: %v", err)
-			continue
+	for _, server := range servers {
+		// Shutting down
+		if ctx.Err() != nil {
+			return
 		}
 
-		// Check if the server is healthy, if so, set it as active
-		if server.isHealthy() {
-			sm.setServerActive(server, true)
+		// Only the health is changed, a server disabled by an operator stays disabled
+		err := sm.checkHealth(server)
+		sm.sla.recordProbe(server.ID, err == nil)
+		sm.healthChecks.set(server.ID, err)
+		recordHealthCheckMetrics(server.URL, err)
+
+		if err != nil {
+			sm.setServerHealth(server, HealthUnhealthy, fmt.Sprintf("health check failed: %v", err), ActorHealthCheck)
+		} else {
+			sm.setServerHealth(server, HealthHealthy, "health check succeeded", ActorHealthCheck)
 		}
 	}
-}
\ No newline at end of file
+}
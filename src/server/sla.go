@@ -0,0 +1,520 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency buckets of the SLA (in milliseconds), the last bucket has no upper bound.
+// The buckets are persisted in the daily rollups: changing them makes the previous rollups inconsistent
+var SLA_LATENCY_BUCKETS = [...]float64{5, 10, 25, 50, 75, 100, 150, 200, 300, 400, 500, 750, 1000, 1500, 2000, 3000, 5000, 7500, 10000, 20000, 30000, 60000}
+
+// How often the daily rollups are saved to the store (and the rollups of the other replicas reloaded)
+var SLA_FLUSH_INTERVAL time.Duration = 5 * time.Minute
+
+// Windows of the SLA report, and how many hours of statistics are kept in memory (the longest window)
+var SLA_WINDOWS = []slaWindow{{"1h", time.Hour}, {"24h", 24 * time.Hour}, {"30d", 30 * 24 * time.Hour}}
+
+const slaHours = 30 * 24
+
+const slaLatencyBuckets = len(SLA_LATENCY_BUCKETS) + 1
+
+// Outcomes of a proxied request
+type slaOutcome int
+
+const (
+	slaSuccess slaOutcome = iota
+	// Transport error, 5xx or 403
+	slaError
+	// 429 from the node, counted apart since the node is up
+	slaRateLimited
+)
+
+// String names the outcome in the metrics
+func (o slaOutcome) String() string {
+	switch o {
+	case slaError:
+		return "error"
+	case slaRateLimited:
+		return "rate_limited"
+	}
+	return "success"
+}
+
+type slaWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+// slaCounts are the outcomes of the requests and health probes of a node over a period
+type slaCounts struct {
+	Requests      int64
+	Errors        int64
+	RateLimited   int64
+	Probes        int64
+	ProbeFailures int64
+	Latency       [slaLatencyBuckets]int64
+}
+
+// add sums other into the counts
+func (c *slaCounts) add(other *slaCounts) {
+	c.Requests += other.Requests
+	c.Errors += other.Errors
+	c.RateLimited += other.RateLimited
+	c.Probes += other.Probes
+	c.ProbeFailures += other.ProbeFailures
+	for i := range c.Latency {
+		c.Latency[i] += other.Latency[i]
+	}
+}
+
+// slaBucket holds the counts of a minute or an hour (start is the number of minutes or hours since the epoch)
+type slaBucket struct {
+	start  int64
+	counts slaCounts
+}
+
+// nodeSLA keeps the counts of a node: per minute for the last hour, per hour for the last 30 days
+type nodeSLA struct {
+	minutes [60]slaBucket
+	hours   [slaHours]slaBucket
+}
+
+// slaTracker computes the availability, error rate and latency of the nodes over rolling windows, from the proxied requests and the health probes
+type slaTracker struct {
+	mutex sync.Mutex
+	// Counts of the requests and probes of this process
+	nodes map[int]*nodeSLA
+	// Daily counts persisted by the other replicas and the previous runs of the balancer, per node and day (since the epoch)
+	persisted map[int]map[int64]*slaCounts
+	// Identifies the rollups of this process in the store. New at every start, so that a restart doesn't replace the counts saved before it
+	replica string
+}
+
+// SLARollup is the daily summary of a node, persisted by the store. Each replica (process) of the balancer saves its own counts, they are summed on read
+type SLARollup struct {
+	ServerID      int
+	Day           time.Time
+	Replica       string
+	Requests      int64
+	Errors        int64
+	RateLimited   int64
+	Probes        int64
+	ProbeFailures int64
+	// Counts of the SLA_LATENCY_BUCKETS
+	Latency []int64
+	// Percentiles, in milliseconds (for the readers of the table)
+	LatencyP50 float64
+	LatencyP95 float64
+	LatencyP99 float64
+}
+
+func newSLATracker() *slaTracker {
+	return &slaTracker{nodes: make(map[int]*nodeSLA), persisted: make(map[int]map[int64]*slaCounts), replica: newReplicaID()}
+}
+
+// newReplicaID returns the host name followed by random hex digits
+func newReplicaID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "balancer"
+	}
+	return hostname + "-" + hex.EncodeToString(random)
+}
+
+// recordRequest records the outcome of a request proxied to a node
+func (t *slaTracker) recordRequest(id int, outcome slaOutcome, latency time.Duration) {
+	t.record(id, time.Now(), func(c *slaCounts) {
+		c.Requests++
+		switch outcome {
+		case slaError:
+			c.Errors++
+		case slaRateLimited:
+			c.RateLimited++
+		}
+		c.Latency[latencyBucket(latency)]++
+	})
+}
+
+// recordProbe records the result of a health probe of a node
+func (t *slaTracker) recordProbe(id int, healthy bool) {
+	t.record(id, time.Now(), func(c *slaCounts) {
+		c.Probes++
+		if !healthy {
+			c.ProbeFailures++
+		}
+	})
+}
+
+// record applies the change to the minute and hour buckets of the node at the given time, recycling the buckets that are too old
+func (t *slaTracker) record(id int, at time.Time, change func(c *slaCounts)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	node, ok := t.nodes[id]
+	if !ok {
+		node = &nodeSLA{}
+		t.nodes[id] = node
+	}
+
+	minute := at.Unix() / 60
+	change(currentBucket(&node.minutes[minute%int64(len(node.minutes))], minute))
+
+	hour := at.Unix() / 3600
+	change(currentBucket(&node.hours[hour%slaHours], hour))
+}
+
+// currentBucket returns the counts of the bucket, reset if it held an older period
+func currentBucket(bucket *slaBucket, start int64) *slaCounts {
+	if bucket.start != start {
+		*bucket = slaBucket{start: start}
+	}
+	return &bucket.counts
+}
+
+// window sums the counts of a node over the last duration (per minute up to an hour, per hour beyond). The persisted days are only counted
+// when they started inside the window: their counts are not spread over the hours, and would fall partly outside of it otherwise
+func (t *slaTracker) window(id int, duration time.Duration, now time.Time) slaCounts {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var counts slaCounts
+	for day, dayCounts := range t.persisted[id] {
+		if day*24*3600 > now.Add(-duration).Unix() {
+			counts.add(dayCounts)
+		}
+	}
+
+	node, ok := t.nodes[id]
+	if !ok {
+		return counts
+	}
+
+	if duration <= time.Hour {
+		since := now.Unix()/60 - int64(duration/time.Minute)
+		for i := range node.minutes {
+			if node.minutes[i].start > since {
+				counts.add(&node.minutes[i].counts)
+			}
+		}
+		return counts
+	}
+
+	since := now.Unix()/3600 - int64(duration/time.Hour)
+	for i := range node.hours {
+		if node.hours[i].start > since {
+			counts.add(&node.hours[i].counts)
+		}
+	}
+	return counts
+}
+
+// rollups returns the daily summaries of the counts of this process, for all the nodes and the given day (UTC)
+func (t *slaTracker) rollups(day time.Time) []*SLARollup {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	day = day.UTC().Truncate(24 * time.Hour)
+	first := day.Unix() / 3600
+
+	var rollups []*SLARollup
+	for id, node := range t.nodes {
+		var counts slaCounts
+		for i := range node.hours {
+			if start := node.hours[i].start; start >= first && start < first+24 {
+				counts.add(&node.hours[i].counts)
+			}
+		}
+		if counts.Requests == 0 && counts.Probes == 0 {
+			continue
+		}
+
+		rollups = append(rollups, &SLARollup{
+			ServerID:      id,
+			Day:           day,
+			Replica:       t.replica,
+			Requests:      counts.Requests,
+			Errors:        counts.Errors,
+			RateLimited:   counts.RateLimited,
+			Probes:        counts.Probes,
+			ProbeFailures: counts.ProbeFailures,
+			Latency:       counts.Latency[:],
+			LatencyP50:    counts.percentile(0.50),
+			LatencyP95:    counts.percentile(0.95),
+			LatencyP99:    counts.percentile(0.99),
+		})
+	}
+
+	return rollups
+}
+
+// load replaces the persisted days by the sums of the rollups of the other replicas, so that the windows survive restarts and cover every replica.
+// The rollups of this process are skipped, its counts are in memory
+func (t *slaTracker) load(rollups []*SLARollup) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.persisted = make(map[int]map[int64]*slaCounts)
+	for _, rollup := range rollups {
+		if rollup.Replica == t.replica {
+			continue
+		}
+		if len(rollup.Latency) != slaLatencyBuckets {
+			log.Printf("Ignoring SLA rollup of server %d on %s: latency buckets changed", rollup.ServerID, rollup.Day.Format(time.DateOnly))
+			continue
+		}
+
+		days, ok := t.persisted[rollup.ServerID]
+		if !ok {
+			days = make(map[int64]*slaCounts)
+			t.persisted[rollup.ServerID] = days
+		}
+
+		day := rollup.Day.UTC().Truncate(24*time.Hour).Unix() / (24 * 3600)
+		counts, ok := days[day]
+		if !ok {
+			counts = &slaCounts{}
+			days[day] = counts
+		}
+		counts.add(&slaCounts{
+			Requests:      rollup.Requests,
+			Errors:        rollup.Errors,
+			RateLimited:   rollup.RateLimited,
+			Probes:        rollup.Probes,
+			ProbeFailures: rollup.ProbeFailures,
+		})
+		for i := range counts.Latency {
+			counts.Latency[i] += rollup.Latency[i]
+		}
+	}
+}
+
+// loadSLA restores the rollups of the last 30 days from the store
+func (sm *ServerManager) loadSLA(ctx context.Context) {
+	rollups, err := sm.store.GetSLARollups(ctx, time.Now().Add(-slaHours*time.Hour))
+	if err != nil {
+		log.Printf("Error loading SLA rollups: %v", err)
+		return
+	}
+
+	sm.sla.load(rollups)
+}
+
+// startSLAFlush saves the daily rollups of today and yesterday (completed after midnight) every SLA_FLUSH_INTERVAL, and reloads the rollups of the
+// other replicas, until the context is done
+func (sm *ServerManager) startSLAFlush(ctx context.Context) {
+	ticker := time.NewTicker(SLA_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.flushSLA(ctx)
+			sm.loadSLA(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushSLA saves the daily rollups of today and yesterday
+func (sm *ServerManager) flushSLA(ctx context.Context) {
+	now := time.Now()
+	rollups := append(sm.sla.rollups(now.Add(-24*time.Hour)), sm.sla.rollups(now)...)
+	if len(rollups) == 0 {
+		return
+	}
+
+	if err := sm.store.SaveSLARollups(ctx, rollups); err != nil {
+		log.Printf("Error saving SLA rollups: %v", err)
+	}
+}
+
+// latencyBucket returns the index of the latency bucket
+func latencyBucket(latency time.Duration) int {
+	ms := float64(latency) / float64(time.Millisecond)
+	return sort.SearchFloat64s(SLA_LATENCY_BUCKETS[:], ms)
+}
+
+// percentile estimates the latency percentile (in milliseconds) from the buckets, interpolating inside the bucket. Returns 0 without requests
+func (c *slaCounts) percentile(p float64) float64 {
+	var total int64
+	for _, count := range c.Latency {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := p * float64(total)
+	var cumulative int64
+	for i, count := range c.Latency {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = SLA_LATENCY_BUCKETS[i-1]
+		}
+		// The last bucket has no upper bound, report its lower bound
+		if i == len(SLA_LATENCY_BUCKETS) {
+			return lower
+		}
+		upper := SLA_LATENCY_BUCKETS[i]
+
+		return math.Round(lower + (upper-lower)*(rank-float64(cumulative))/float64(count))
+	}
+
+	return SLA_LATENCY_BUCKETS[len(SLA_LATENCY_BUCKETS)-1]
+}
+
+// SLAStats are the availability, error rate and latency of a node (or a provider) over a window
+type SLAStats struct {
+	Requests      int64 `json:"requests"`
+	Errors        int64 `json:"errors"`
+	RateLimited   int64 `json:"rate_limited"`
+	Probes        int64 `json:"probes"`
+	ProbeFailures int64 `json:"probe_failures"`
+	// Percentage of the requests and health probes that succeeded (rate limited requests are not counted), null without any
+	Availability *float64 `json:"availability"`
+	// Percentage of the requests that failed, null without requests
+	ErrorRate *float64 `json:"error_rate"`
+	// Latency percentiles of the requests, in milliseconds
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP95 float64 `json:"latency_p95_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+}
+
+// newSLAStats computes the stats of the counts
+func newSLAStats(c *slaCounts) SLAStats {
+	stats := SLAStats{
+		Requests:      c.Requests,
+		Errors:        c.Errors,
+		RateLimited:   c.RateLimited,
+		Probes:        c.Probes,
+		ProbeFailures: c.ProbeFailures,
+		LatencyP50:    c.percentile(0.50),
+		LatencyP95:    c.percentile(0.95),
+		LatencyP99:    c.percentile(0.99),
+	}
+
+	if checks := c.Requests - c.RateLimited + c.Probes; checks > 0 {
+		availability := percentage(checks-c.Errors-c.ProbeFailures, checks)
+		stats.Availability = &availability
+	}
+	if c.Requests > 0 {
+		errorRate := percentage(c.Errors, c.Requests)
+		stats.ErrorRate = &errorRate
+	}
+
+	return stats
+}
+
+// percentage returns part / total in percent, rounded to 3 decimals
+func percentage(part, total int64) float64 {
+	return math.Round(float64(part)/float64(total)*100*1000) / 1000
+}
+
+// SLANodeReport is the SLA of a node, per window
+type SLANodeReport struct {
+	ID       int                 `json:"id"`
+	URL      string              `json:"url"`
+	Provider string              `json:"provider"`
+	Windows  map[string]SLAStats `json:"windows"`
+}
+
+// SLAProviderReport is the SLA of all the nodes of a provider, per window
+type SLAProviderReport struct {
+	Provider string              `json:"provider"`
+	Nodes    []int               `json:"nodes"`
+	Windows  map[string]SLAStats `json:"windows"`
+}
+
+// SLAReport is the SLA of the nodes and of the providers
+type SLAReport struct {
+	GeneratedAt time.Time           `json:"generated_at"`
+	Nodes       []SLANodeReport     `json:"nodes"`
+	Providers   []SLAProviderReport `json:"providers"`
+}
+
+// slaReport computes the SLA of the servers of the store, and of their providers, over every window
+func (sm *ServerManager) slaReport(ctx context.Context) (*SLAReport, error) {
+	servers, err := sm.store.GetServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	report := &SLAReport{GeneratedAt: now, Nodes: []SLANodeReport{}, Providers: []SLAProviderReport{}}
+
+	providers := make(map[string]*SLAProviderReport)
+	providerCounts := make(map[string]map[string]*slaCounts)
+	var providerNames []string
+
+	for _, server := range servers {
+		provider := providerOf(server.URL)
+		if _, ok := providers[provider]; !ok {
+			providers[provider] = &SLAProviderReport{Provider: provider, Windows: make(map[string]SLAStats)}
+			providerCounts[provider] = make(map[string]*slaCounts)
+			providerNames = append(providerNames, provider)
+		}
+		providers[provider].Nodes = append(providers[provider].Nodes, server.ID)
+
+		node := SLANodeReport{ID: server.ID, URL: server.URL, Provider: provider, Windows: make(map[string]SLAStats)}
+		for _, window := range SLA_WINDOWS {
+			counts := sm.sla.window(server.ID, window.Duration, now)
+			node.Windows[window.Name] = newSLAStats(&counts)
+
+			if providerCounts[provider][window.Name] == nil {
+				providerCounts[provider][window.Name] = &slaCounts{}
+			}
+			providerCounts[provider][window.Name].add(&counts)
+		}
+		report.Nodes = append(report.Nodes, node)
+	}
+
+	sort.Strings(providerNames)
+	for _, name := range providerNames {
+		provider := providers[name]
+		for window, counts := range providerCounts[name] {
+			provider.Windows[window] = newSLAStats(counts)
+		}
+		report.Providers = append(report.Providers, *provider)
+	}
+
+	return report, nil
+}
+
+// providerOf returns the provider of a server, from the domain of its URL (eg "eth.llamarpc.com" -> "llamarpc.com"). IP addresses are their own provider
+func providerOf(serverURL string) string {
+	parsed, err := url.Parse(serverURL)
+	if err != nil || parsed.Hostname() == "" {
+		return serverURL
+	}
+
+	host := parsed.Hostname()
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// AdminState is the decision of an operator: a disabled server is never routed to, whatever its health
+type AdminState string
+
+const (
+	AdminEnabled  AdminState = "enabled"
+	AdminDisabled AdminState = "disabled"
+)
+
+// HealthState is the health of a server, as observed by the balancer (health checks, 403 responses). Unhealthy servers are not routed to until a health check succeeds
+type HealthState string
+
+const (
+	HealthUnknown   HealthState = "unknown"
+	HealthHealthy   HealthState = "healthy"
+	HealthUnhealthy HealthState = "unhealthy"
+)
+
+// ParseAdminState parses an admin state (enabled or disabled)
+func ParseAdminState(s string) (AdminState, error) {
+	switch state := AdminState(s); state {
+	case AdminEnabled, AdminDisabled:
+		return state, nil
+	}
+	return "", fmt.Errorf("invalid admin state: %q. Must be 'enabled' or 'disabled'", s)
+}
+
+// setAdminState changes the admin state of the server, and records why and when
+func (server *RPCServer) setAdminState(state AdminState, reason string) {
+	server.AdminState = state
+	server.AdminReason = reason
+	server.AdminChangedAt = time.Now()
+	server.updateIsActive()
+}
+
+// setHealthState changes the health state of the server, and records why and when
+func (server *RPCServer) setHealthState(state HealthState, reason string) {
+	server.HealthState = state
+	server.HealthReason = reason
+	server.HealthChangedAt = time.Now()
+	server.updateIsActive()
+}
+
+// updateIsActive computes whether requests can be routed to the server: enabled by the operators, and not known to be unhealthy
+func (server *RPCServer) updateIsActive() {
+	server.IsActive = server.AdminState == AdminEnabled && server.HealthState != HealthUnhealthy
+}
+
+// normalizeStates fills the states missing from a record (new servers are enabled, with an unknown health), and computes IsActive
+func (server *RPCServer) normalizeStates() {
+	if server.AdminState == "" {
+		server.AdminState = AdminEnabled
+	}
+	if server.HealthState == "" {
+		server.HealthState = HealthUnknown
+	}
+
+	server.updateIsActive()
+}
+
+// copyStatesFrom copies the admin and health states (and draining) of another record of the same server
+func (server *RPCServer) copyStatesFrom(other *RPCServer) {
+	server.AdminState = other.AdminState
+	server.AdminReason = other.AdminReason
+	server.AdminChangedAt = other.AdminChangedAt
+	server.HealthState = other.HealthState
+	server.HealthReason = other.HealthReason
+	server.HealthChangedAt = other.HealthChangedAt
+	server.Draining = other.Draining
+	server.updateIsActive()
+}
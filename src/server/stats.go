@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"load-balancer/src/queue"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Window of the recent error rate and latency reported by /stats
+var STATS_RECENT_WINDOW time.Duration = 5 * time.Minute
+
+// HealthCheckResult is the result of the last health probe of a server
+type HealthCheckResult struct {
+	At      time.Time `json:"at"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// healthChecks keeps the last health probe of each server
+type healthChecks struct {
+	mutex   sync.RWMutex
+	results map[int]HealthCheckResult
+}
+
+func (h *healthChecks) set(id int, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.results == nil {
+		h.results = make(map[int]HealthCheckResult)
+	}
+
+	result := HealthCheckResult{At: time.Now(), Healthy: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	h.results[id] = result
+}
+
+func (h *healthChecks) get(id int) *HealthCheckResult {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	result, ok := h.results[id]
+	if !ok {
+		return nil
+	}
+	return &result
+}
+
+// Stats is the live state of the balancer, as reported by the stats endpoint
+type Stats struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	// Nodes requests are routed to (draining ones excluded)
+	ActiveNodes int `json:"active_nodes"`
+	// Size of the weighted round-robin queue
+	QueueLength int `json:"queue_length"`
+	// Requests being served and waiting for a slot (admission control), absent if disabled
+	Admission *AdmissionStats `json:"admission,omitempty"`
+	Nodes     []NodeStats     `json:"nodes"`
+}
+
+// AdmissionStats is the state of the admission control
+type AdmissionStats struct {
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// NodeStats is the runtime state of a node, as reported by the stats endpoint
+type NodeStats struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+	// active, draining (taken out of rotation, in-flight requests remaining), drained, or inactive (disabled or unhealthy, not routed to)
+	State           string      `json:"state"`
+	AdminState      AdminState  `json:"admin_state"`
+	HealthState     HealthState `json:"health_state"`
+	HealthReason    string      `json:"health_reason"`
+	HealthChangedAt time.Time   `json:"health_changed_at"`
+	// Set while the node is paused after a 429
+	PausedUntil *time.Time `json:"paused_until"`
+	// Occurrences of the node in the weighted queue, and their share of the queue (percentage)
+	QueueSlots int     `json:"queue_slots"`
+	QueueShare float64 `json:"queue_share"`
+	RateLimit  int     `json:"rate_limit"`
+	BurstLimit int     `json:"burst_limit"`
+	// Rate (requests per second) the node is lowered to by the rate limit headers of its provider, and until when. Absent if not lowered
+	ProviderRateLimit *float64   `json:"provider_rate_limit,omitempty"`
+	ProviderRateUntil *time.Time `json:"provider_rate_until,omitempty"`
+	// Tokens remaining in the rate limiter of the node
+	Tokens           float64 `json:"tokens"`
+	ConcurrencyLimit int     `json:"concurrency_limit"`
+	InFlight         int     `json:"in_flight"`
+	// Requests, error rate (percentage, null without requests) and latency percentiles (milliseconds) over STATS_RECENT_WINDOW
+	RecentRequests  int64              `json:"recent_requests"`
+	RecentErrorRate *float64           `json:"recent_error_rate"`
+	LatencyP50      float64            `json:"latency_p50_ms"`
+	LatencyP95      float64            `json:"latency_p95_ms"`
+	LatencyP99      float64            `json:"latency_p99_ms"`
+	LastHealthCheck *HealthCheckResult `json:"last_health_check"`
+}
+
+// HandleStats returns the live state of the servers: the in-memory state of the nodes, and the servers out of rotation from the store. Supports ?format=json (default) or text, and ?node=<id> to report a single node
+func (b *Balancer) HandleStats(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		http.Error(w, "Invalid format: must be 'json' or 'text'", http.StatusBadRequest)
+		return
+	}
+
+	nodeID := 0
+	if nodeIDStr := r.URL.Query().Get("node"); nodeIDStr != "" {
+		var err error
+		if nodeID, err = strconv.Atoi(nodeIDStr); err != nil {
+			http.Error(w, "Invalid node query parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats := b.stats(r.Context(), nodeID)
+	if nodeID != 0 && len(stats.Nodes) == 0 {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	if format == "text" {
+		writeStatsText(w, stats)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// stats collects the live state of the servers (all of them if nodeID is 0). The servers out of rotation (disabled, unhealthy) have no node,
+// they are read from the store and reported with their health and last health check
+func (b *Balancer) stats(ctx context.Context, nodeID int) *Stats {
+	sm := b.ServerManager
+	now := time.Now()
+
+	slots, queueLength := sm.queueSlots()
+	stats := &Stats{GeneratedAt: now, QueueLength: queueLength, Nodes: []NodeStats{}}
+
+	if b.Admission != nil {
+		stats.Admission = &AdmissionStats{InFlight: b.Admission.InFlight(), Queued: b.Admission.Queued()}
+	}
+
+	reported := make(map[int]bool)
+	for _, node := range sm.getNodes() {
+		reported[node.ID] = true
+		if !node.Draining {
+			stats.ActiveNodes++
+		}
+		if nodeID != 0 && node.ID != nodeID {
+			continue
+		}
+
+		nodeStats := sm.serverStats(node.RPCServer, now)
+		nodeStats.State = node.state()
+		nodeStats.QueueSlots = slots[node.ID]
+		nodeStats.Tokens = node.limiter.TokensAt(now)
+		nodeStats.ConcurrencyLimit = node.concurrency.Limit()
+		nodeStats.InFlight = node.concurrency.InFlight()
+		if queueLength > 0 {
+			nodeStats.QueueShare = percentage(int64(slots[node.ID]), int64(queueLength))
+		}
+		if until := node.backoff.PausedUntil(); until.After(now) {
+			nodeStats.PausedUntil = &until
+		}
+		if until := node.backoff.TunedUntil(); until.After(now) {
+			providerRate := float64(node.limiter.Limit())
+			nodeStats.ProviderRateLimit = &providerRate
+			nodeStats.ProviderRateUntil = &until
+		}
+
+		stats.Nodes = append(stats.Nodes, nodeStats)
+	}
+
+	// The servers out of rotation, only the cached nodes are reported if the store cannot be read
+	servers, err := sm.store.GetServers(ctx)
+	if err != nil {
+		log.Printf("Error reading the servers for the stats: %v", err)
+	}
+	for _, server := range servers {
+		if reported[server.ID] || (nodeID != 0 && server.ID != nodeID) {
+			continue
+		}
+
+		nodeStats := sm.serverStats(server, now)
+		nodeStats.State = "inactive"
+		stats.Nodes = append(stats.Nodes, nodeStats)
+	}
+
+	sort.Slice(stats.Nodes, func(i, j int) bool { return stats.Nodes[i].ID < stats.Nodes[j].ID })
+
+	return stats
+}
+
+// serverStats reports the state of a server, its recent requests and its last health check (the state of its node is set by the caller)
+func (sm *ServerManager) serverStats(server *RPCServer, now time.Time) NodeStats {
+	recent := sm.sla.window(server.ID, STATS_RECENT_WINDOW, now)
+	nodeStats := NodeStats{
+		ID:              server.ID,
+		URL:             server.URL,
+		AdminState:      server.AdminState,
+		HealthState:     server.HealthState,
+		HealthReason:    server.HealthReason,
+		HealthChangedAt: server.HealthChangedAt,
+		RateLimit:       server.RateLimit,
+		BurstLimit:      server.BurstLimit,
+		RecentRequests:  recent.Requests,
+		LatencyP50:      recent.percentile(0.50),
+		LatencyP95:      recent.percentile(0.95),
+		LatencyP99:      recent.percentile(0.99),
+		LastHealthCheck: sm.healthChecks.get(server.ID),
+	}
+	if recent.Requests > 0 {
+		errorRate := percentage(recent.Errors, recent.Requests)
+		nodeStats.RecentErrorRate = &errorRate
+	}
+	return nodeStats
+}
+
+// queueSlots counts the occurrences of each node in the weighted queue, and returns the length of the queue
+func (sm *ServerManager) queueSlots() (map[int]int, int) {
+	sm.cacheMutex.RLock()
+	defer sm.cacheMutex.RUnlock()
+
+	if sm.cache == nil {
+		return make(map[int]int), 0
+	}
+
+	return weightedQueueSlots(sm.cache), sm.cache.Length()
+}
+
+// weightedQueueSlots counts the occurrences of each node in a weighted queue
+func weightedQueueSlots(queue *queue.RingQueue[*Node]) map[int]int {
+	slots := make(map[int]int)
+	if queue.Length() == 0 {
+		return slots
+	}
+
+	for element := queue.HeadElement(); element != nil; element = element.Next {
+		slots[element.Value.ID]++
+	}
+
+	return slots
+}
+
+// writeStatsText writes the stats as a table, for humans
+func writeStatsText(w http.ResponseWriter, stats *Stats) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	fmt.Fprintf(w, "Generated at: %s\n", stats.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Active nodes: %d, queue length: %d\n", stats.ActiveNodes, stats.QueueLength)
+	if stats.Admission != nil {
+		fmt.Fprintf(w, "Admission: %d in flight, %d queued\n", stats.Admission.InFlight, stats.Admission.Queued)
+	}
+	fmt.Fprintln(w)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tURL\tSTATE\tADMIN\tHEALTH\tPAUSED\tSLOTS\tTOKENS\tIN FLIGHT\tREQUESTS\tERRORS\tP50\tP95\tP99\tLAST CHECK")
+	for _, node := range stats.Nodes {
+		paused := "-"
+		if node.PausedUntil != nil {
+			paused = time.Until(*node.PausedUntil).Round(time.Second).String()
+		}
+
+		errorRate := "-"
+		if node.RecentErrorRate != nil {
+			errorRate = fmt.Sprintf("%.1f%%", *node.RecentErrorRate)
+		}
+
+		lastCheck := "-"
+		if check := node.LastHealthCheck; check != nil {
+			lastCheck = check.At.Format(time.RFC3339) + " ok"
+			if !check.Healthy {
+				lastCheck = check.At.Format(time.RFC3339) + " " + check.Error
+			}
+		}
+
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%s\t%d (%.1f%%)\t%.1f/%d\t%d/%d\t%d\t%s\t%.0fms\t%.0fms\t%.0fms\t%s\n",
+			node.ID, node.URL, node.State, node.AdminState, node.HealthState, paused,
+			node.QueueSlots, node.QueueShare, node.Tokens, node.BurstLimit, node.InFlight, node.ConcurrencyLimit,
+			node.RecentRequests, errorRate, node.LatencyP50, node.LatencyP95, node.LatencyP99, lastCheck)
+	}
+	table.Flush()
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ServerStore is where the servers are stored (Postgres, a file for local and small setups, or discovered from DNS)
+type ServerStore interface {
+	// GetActiveServers retrieves the servers requests can be routed to (enabled, and not unhealthy)
+	GetActiveServers(ctx context.Context) ([]*RPCServer, error)
+	// GetServersToCheck retrieves the servers whose health is unhealthy or unknown (checked by the health check)
+	GetServersToCheck(ctx context.Context) ([]*RPCServer, error)
+	// GetServers retrieves all the servers (active or not)
+	GetServers(ctx context.Context) ([]*RPCServer, error)
+	// GetServer retrieves a server by id, returns nil if it does not exist
+	GetServer(ctx context.Context, id int) (*RPCServer, error)
+	// GetServerByURL retrieves a server by URL, returns nil if it does not exist
+	GetServerByURL(ctx context.Context, url string) (*RPCServer, error)
+
+	// CreateServer adds a new server, and sets its id and timestamps
+	CreateServer(ctx context.Context, server *RPCServer) error
+	// UpdateServer saves the url, limits, admin state and draining of a server (the health is only changed by SetServerHealth)
+	UpdateServer(ctx context.Context, server *RPCServer) error
+	// DeleteServer removes a server
+	DeleteServer(ctx context.Context, id int) error
+	// SetServerHealth sets the health of a server, with the reason of the change
+	SetServerHealth(ctx context.Context, id int, state HealthState, reason string) error
+	// SetServerAdminState enables or disables a server, with the reason of the change
+	SetServerAdminState(ctx context.Context, id int, state AdminState, reason string) error
+	// SetServerDraining sets whether a server is draining (taken out of rotation for maintenance)
+	SetServerDraining(ctx context.Context, id int, draining bool) error
+
+	// AddServerEvent records a change of the state of a server, and sets its id and time
+	AddServerEvent(ctx context.Context, event *ServerEvent) error
+	// GetServerEvents retrieves the latest events of a server (kept after it is deleted), most recent first
+	GetServerEvents(ctx context.Context, serverID int, limit int) ([]*ServerEvent, error)
+
+	// SaveSLARollups saves the daily SLA summaries of the servers (replacing the previous ones of the same days and replica)
+	SaveSLARollups(ctx context.Context, rollups []*SLARollup) error
+	// GetSLARollups retrieves the daily SLA summaries of all the replicas since the given time
+	GetSLARollups(ctx context.Context, since time.Time) ([]*SLARollup, error)
+
+	// Watch calls onChange whenever the servers have been changed (including outside of this balancer), until the context is done
+	Watch(ctx context.Context, onChange func())
+	// Close releases the resources of the store
+	Close() error
+}
+
+// newServerStore creates the store selected by the configuration
+func newServerStore(config Config) (ServerStore, error) {
+	if config.ServerStore != nil {
+		return config.ServerStore, nil
+	}
+
+	switch config.Store {
+	case "", "postgres":
+		return newPostgresStore(config.PostgresURL, config.SecretsKey)
+	case "file":
+		return newFileStore(config.ServersFile)
+	case "dns":
+		return newDNSStore(config.DNS)
+	}
+
+	return nil, fmt.Errorf("invalid server store: %s. Must be 'postgres', 'file' or 'dns'", config.Store)
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReadOnlyStore is returned when editing the servers of a store that cannot be edited (eg discovered from DNS)
+var ErrReadOnlyStore = errors.New("servers cannot be edited: they are discovered from DNS")
+
+// DNSConfig configures the discovery of the servers from DNS records
+type DNSConfig struct {
+	// Name to resolve, eg "_rpc._tcp.example.com" for SRV records or "rpc.example.com" for A/AAAA records
+	Name string
+	// Type of records: "srv" (default) or "a"
+	Record string
+	// DNS server to query (host:port), the system resolver is used if empty
+	Server string
+	// Scheme of the servers URLs (http or https)
+	Scheme string
+	// Port of the servers, for A/AAAA records (SRV records carry their own port)
+	Port int
+	// How often the name is resolved again
+	RefreshInterval time.Duration
+	// Default profile, used for A/AAAA records and SRV records with a zero weight
+	DefaultRateLimit  int
+	DefaultBurstLimit int
+}
+
+// dnsRecord is a server discovered from DNS
+type dnsRecord struct {
+	server   *RPCServer
+	priority uint16
+}
+
+// dnsStore discovers the servers from DNS SRV or A/AAAA records, and resolves them again periodically.
+// For SRV records, the weight is the rate limit of the server, and only the lowest priority group having active servers is used (the other groups are backups).
+// Servers are read-only, except for their states (admin state, health, draining), which are kept in memory.
+type dnsStore struct {
+	mutex    sync.RWMutex
+	config   DNSConfig
+	resolver *net.Resolver
+	records  []*dnsRecord
+	// Ids are kept across resolutions, so that the nodes keep their state
+	ids    map[string]int
+	nextID int
+	// Only the latest events are kept in memory
+	events memoryEvents
+}
+
+// newDNSStore creates the store and resolves the servers a first time
+func newDNSStore(config DNSConfig) (*dnsStore, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("a DNS name is required by the dns store")
+	}
+	if config.Record == "" {
+		config.Record = "srv"
+	}
+	if config.Record != "srv" && config.Record != "a" {
+		return nil, fmt.Errorf("invalid DNS record type: %s. Must be 'srv' or 'a'", config.Record)
+	}
+	if config.Scheme == "" {
+		config.Scheme = "http"
+	}
+
+	resolver := net.DefaultResolver
+	if config.Server != "" {
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, config.Server)
+			},
+		}
+	}
+
+	s := &dnsStore{
+		config:   config,
+		resolver: resolver,
+		ids:      make(map[string]int),
+		nextID:   1,
+	}
+
+	if _, err := s.resolve(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetActiveServers retrieves the active servers of the lowest priority group having active servers
+func (s *dnsStore) GetActiveServers(ctx context.Context) ([]*RPCServer, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var servers []*RPCServer
+	for i, record := range s.records {
+		// Records are sorted by priority, stop at the end of the first group having active servers
+		if len(servers) > 0 && record.priority != s.records[i-1].priority {
+			break
+		}
+		if record.server.IsActive {
+			copied := *record.server
+			servers = append(servers, &copied)
+		}
+	}
+
+	return servers, nil
+}
+
+// GetServersToCheck retrieves the servers whose health is unhealthy or unknown (checked by the health check)
+func (s *dnsStore) GetServersToCheck(ctx context.Context) ([]*RPCServer, error) {
+	return s.filter(func(server *RPCServer) bool { return server.HealthState != HealthHealthy }), nil
+}
+
+// GetServers retrieves all the discovered servers
+func (s *dnsStore) GetServers(ctx context.Context) ([]*RPCServer, error) {
+	return s.filter(func(server *RPCServer) bool { return true }), nil
+}
+
+// GetServer retrieves a server by id, returns nil if it does not exist
+func (s *dnsStore) GetServer(ctx context.Context, id int) (*RPCServer, error) {
+	servers := s.filter(func(server *RPCServer) bool { return server.ID == id })
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	return servers[0], nil
+}
+
+// GetServerByURL retrieves a server by URL, returns nil if it does not exist
+func (s *dnsStore) GetServerByURL(ctx context.Context, url string) (*RPCServer, error) {
+	servers := s.filter(func(server *RPCServer) bool { return server.URL == url })
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	return servers[0], nil
+}
+
+// CreateServer is not supported, servers are discovered from DNS
+func (s *dnsStore) CreateServer(ctx context.Context, server *RPCServer) error {
+	return ErrReadOnlyStore
+}
+
+// UpdateServer is not supported, servers are discovered from DNS
+func (s *dnsStore) UpdateServer(ctx context.Context, server *RPCServer) error {
+	return ErrReadOnlyStore
+}
+
+// DeleteServer is not supported, servers are discovered from DNS
+func (s *dnsStore) DeleteServer(ctx context.Context, id int) error {
+	return ErrReadOnlyStore
+}
+
+// SetServerHealth sets the health of a server (in memory)
+func (s *dnsStore) SetServerHealth(ctx context.Context, id int, state HealthState, reason string) error {
+	return s.update(id, func(server *RPCServer) { server.setHealthState(state, reason) })
+}
+
+// SetServerAdminState enables or disables a server (in memory)
+func (s *dnsStore) SetServerAdminState(ctx context.Context, id int, state AdminState, reason string) error {
+	return s.update(id, func(server *RPCServer) { server.setAdminState(state, reason) })
+}
+
+// SetServerDraining sets whether a server is draining (in memory)
+func (s *dnsStore) SetServerDraining(ctx context.Context, id int, draining bool) error {
+	return s.update(id, func(server *RPCServer) { server.Draining = draining })
+}
+
+// AddServerEvent records a change of the state of a server (in memory)
+func (s *dnsStore) AddServerEvent(ctx context.Context, event *ServerEvent) error {
+	s.events.add(event)
+	return nil
+}
+
+// GetServerEvents retrieves the latest events of a server, most recent first
+func (s *dnsStore) GetServerEvents(ctx context.Context, serverID int, limit int) ([]*ServerEvent, error) {
+	return s.events.get(serverID, limit), nil
+}
+
+// SaveSLARollups does nothing: SLA rollups are not persisted by the dns store, the SLA only covers the uptime of the balancer
+func (s *dnsStore) SaveSLARollups(ctx context.Context, rollups []*SLARollup) error {
+	return nil
+}
+
+// GetSLARollups returns no rollups, they are not persisted
+func (s *dnsStore) GetSLARollups(ctx context.Context, since time.Time) ([]*SLARollup, error) {
+	return nil, nil
+}
+
+// Watch resolves the name again every refresh interval, and calls onChange when the servers changed, until the context is done
+func (s *dnsStore) Watch(ctx context.Context, onChange func()) {
+	ticker := time.NewTicker(s.config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := s.resolve(ctx)
+			if err != nil {
+				log.Printf("Error resolving %s, keeping the previous servers: %v", s.config.Name, err)
+				continue
+			}
+
+			if changed {
+				log.Printf("Servers of %s changed, reloading servers", s.config.Name)
+				onChange()
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close has nothing to release for the dns store
+func (s *dnsStore) Close() error {
+	return nil
+}
+
+// resolve queries the DNS records and replaces the servers. Returns true if they changed
+func (s *dnsStore) resolve(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var records []*dnsRecord
+
+	switch s.config.Record {
+	case "srv":
+		_, srvs, err := s.resolver.LookupSRV(ctx, "", "", s.config.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to resolve SRV records of %s: %v", s.config.Name, err)
+		}
+
+		for _, srv := range srvs {
+			rateLimit := int(srv.Weight)
+			if rateLimit == 0 {
+				rateLimit = s.config.DefaultRateLimit
+			}
+
+			host := strings.TrimSuffix(srv.Target, ".")
+			records = append(records, &dnsRecord{
+				server:   s.newServer(net.JoinHostPort(host, strconv.Itoa(int(srv.Port))), rateLimit),
+				priority: srv.Priority,
+			})
+		}
+
+	case "a":
+		ips, err := s.resolver.LookupIPAddr(ctx, s.config.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to resolve A records of %s: %v", s.config.Name, err)
+		}
+
+		for _, ip := range ips {
+			records = append(records, &dnsRecord{
+				server: s.newServer(net.JoinHostPort(ip.String(), strconv.Itoa(s.config.Port)), s.config.DefaultRateLimit),
+			})
+		}
+	}
+
+	if len(records) == 0 {
+		return false, fmt.Errorf("no records found for %s", s.config.Name)
+	}
+
+	// Sort by priority, then by id for a deterministic order
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].priority != records[j].priority {
+			return records[i].priority < records[j].priority
+		}
+		return records[i].server.ID < records[j].server.ID
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The states of the servers already discovered are kept
+	previous := make(map[int]*RPCServer)
+	for _, record := range s.records {
+		previous[record.server.ID] = record.server
+	}
+	for _, record := range records {
+		if server, ok := previous[record.server.ID]; ok {
+			record.server.copyStatesFrom(server)
+			record.server.CreatedAt = server.CreatedAt
+		}
+	}
+
+	changed := !sameRecords(s.records, records)
+	s.records = records
+
+	return changed, nil
+}
+
+// newServer creates the server of a resolved host:port, reusing its id if it has already been discovered
+func (s *dnsStore) newServer(hostPort string, rateLimit int) *RPCServer {
+	url := s.config.Scheme + "://" + hostPort
+
+	s.mutex.Lock()
+	id, ok := s.ids[url]
+	if !ok {
+		id = s.nextID
+		s.ids[url] = id
+		s.nextID++
+	}
+	s.mutex.Unlock()
+
+	now := time.Now()
+	server := &RPCServer{
+		ID:         id,
+		URL:        url,
+		RateLimit:  rateLimit,
+		BurstLimit: s.config.DefaultBurstLimit,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	server.normalizeStates()
+
+	return server
+}
+
+// filter returns copies of the servers matching the predicate
+func (s *dnsStore) filter(match func(server *RPCServer) bool) []*RPCServer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var servers []*RPCServer
+	for _, record := range s.records {
+		if match(record.server) {
+			copied := *record.server
+			servers = append(servers, &copied)
+		}
+	}
+
+	return servers
+}
+
+// update edits the state of the server with the given id
+func (s *dnsStore) update(id int, edit func(server *RPCServer)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range s.records {
+		if record.server.ID == id {
+			edit(record.server)
+			record.server.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to update server %d: not found", id)
+}
+
+// sameRecords returns true if both resolutions gave the same servers (same order, urls, limits and priorities)
+func sameRecords(a, b []*dnsRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].priority != b[i].priority ||
+			a[i].server.URL != b[i].server.URL ||
+			a[i].server.RateLimit != b[i].server.RateLimit ||
+			a[i].server.BurstLimit != b[i].server.BurstLimit {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often the servers file is checked for changes
+var FILE_WATCH_INTERVAL time.Duration = 2 * time.Second
+
+// serversFile is the content of the servers file
+type serversFile struct {
+	Servers []*RPCServer `json:"servers"`
+}
+
+// fileStore stores the servers in a JSON or YAML file (depending on its extension), for local and small setups without Postgres.
+// The file is watched, so it can be edited by hand while the balancer is running
+type fileStore struct {
+	mutex   sync.RWMutex
+	path    string
+	servers []*RPCServer
+	modTime time.Time
+	// Events are not written to the file, only the latest ones are kept in memory
+	events memoryEvents
+}
+
+// newFileStore loads the servers file (an empty store is created if it does not exist yet)
+func newFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a servers file is required by the file store")
+	}
+
+	s := &fileStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetActiveServers retrieves all active servers (enabled, and not unhealthy) from the file
+func (s *fileStore) GetActiveServers(ctx context.Context) ([]*RPCServer, error) {
+	return s.filter(func(server *RPCServer) bool { return server.IsActive }), nil
+}
+
+// GetServersToCheck retrieves the servers whose health is unhealthy or unknown (checked by the health check)
+func (s *fileStore) GetServersToCheck(ctx context.Context) ([]*RPCServer, error) {
+	return s.filter(func(server *RPCServer) bool { return server.HealthState != HealthHealthy }), nil
+}
+
+// GetServers retrieves all the servers (active or not) from the file
+func (s *fileStore) GetServers(ctx context.Context) ([]*RPCServer, error) {
+	return s.filter(func(server *RPCServer) bool { return true }), nil
+}
+
+// GetServer retrieves a server by id, returns nil if it does not exist
+func (s *fileStore) GetServer(ctx context.Context, id int) (*RPCServer, error) {
+	servers := s.filter(func(server *RPCServer) bool { return server.ID == id })
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	return servers[0], nil
+}
+
+// GetServerByURL retrieves a server by URL, returns nil if it does not exist
+func (s *fileStore) GetServerByURL(ctx context.Context, url string) (*RPCServer, error) {
+	servers := s.filter(func(server *RPCServer) bool { return server.URL == url })
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	return servers[0], nil
+}
+
+// CreateServer adds a new server to the file, and sets its id and timestamps
+func (s *fileStore) CreateServer(ctx context.Context, server *RPCServer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.servers {
+		if existing.URL == server.URL {
+			return fmt.Errorf("failed to create server: url %s already exists", server.URL)
+		}
+		if existing.ID >= server.ID {
+			server.ID = existing.ID + 1
+		}
+	}
+	if server.ID == 0 {
+		server.ID = 1
+	}
+
+	server.CreatedAt = time.Now()
+	server.UpdatedAt = server.CreatedAt
+	server.normalizeStates()
+
+	copied := *server
+	s.servers = append(s.servers, &copied)
+
+	return s.save()
+}
+
+// UpdateServer saves the url, limits, admin state and draining of a server in the file (the health is kept)
+func (s *fileStore) UpdateServer(ctx context.Context, server *RPCServer) error {
+	return s.update(server.ID, func(existing *RPCServer) {
+		server.CreatedAt = existing.CreatedAt
+		server.UpdatedAt = time.Now()
+		server.HealthState = existing.HealthState
+		server.HealthReason = existing.HealthReason
+		server.HealthChangedAt = existing.HealthChangedAt
+		if server.AdminState != existing.AdminState {
+			server.AdminChangedAt = server.UpdatedAt
+		}
+		server.normalizeStates()
+		*existing = *server
+	})
+}
+
+// DeleteServer removes a server from the file
+func (s *fileStore) DeleteServer(ctx context.Context, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, server := range s.servers {
+		if server.ID == id {
+			s.servers = append(s.servers[:i], s.servers[i+1:]...)
+			return s.save()
+		}
+	}
+
+	return nil
+}
+
+// SetServerHealth sets the health of a server, with the reason of the change
+func (s *fileStore) SetServerHealth(ctx context.Context, id int, state HealthState, reason string) error {
+	return s.update(id, func(existing *RPCServer) {
+		existing.setHealthState(state, reason)
+		existing.UpdatedAt = time.Now()
+	})
+}
+
+// SetServerAdminState enables or disables a server, with the reason of the change
+func (s *fileStore) SetServerAdminState(ctx context.Context, id int, state AdminState, reason string) error {
+	return s.update(id, func(existing *RPCServer) {
+		existing.setAdminState(state, reason)
+		existing.UpdatedAt = time.Now()
+	})
+}
+
+// SetServerDraining sets whether a server is draining
+func (s *fileStore) SetServerDraining(ctx context.Context, id int, draining bool) error {
+	return s.update(id, func(existing *RPCServer) {
+		existing.Draining = draining
+		existing.UpdatedAt = time.Now()
+	})
+}
+
+// AddServerEvent records a change of the state of a server (in memory)
+func (s *fileStore) AddServerEvent(ctx context.Context, event *ServerEvent) error {
+	s.events.add(event)
+	return nil
+}
+
+// GetServerEvents retrieves the latest events of a server, most recent first
+func (s *fileStore) GetServerEvents(ctx context.Context, serverID int, limit int) ([]*ServerEvent, error) {
+	return s.events.get(serverID, limit), nil
+}
+
+// SaveSLARollups does nothing: SLA rollups are not persisted by the file store, the SLA only covers the uptime of the balancer
+func (s *fileStore) SaveSLARollups(ctx context.Context, rollups []*SLARollup) error {
+	return nil
+}
+
+// GetSLARollups returns no rollups, they are not persisted
+func (s *fileStore) GetSLARollups(ctx context.Context, since time.Time) ([]*SLARollup, error) {
+	return nil, nil
+}
+
+// Watch checks the file for changes every FILE_WATCH_INTERVAL, reloads it and calls onChange when it has been modified, until the context is done
+func (s *fileStore) Watch(ctx context.Context, onChange func()) {
+	ticker := time.NewTicker(FILE_WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(s.path)
+			if err != nil {
+				continue
+			}
+
+			s.mutex.RLock()
+			changed := !info.ModTime().Equal(s.modTime)
+			s.mutex.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			if err := s.load(); err != nil {
+				log.Printf("Error reloading servers file, keeping the previous servers: %v", err)
+				continue
+			}
+
+			log.Printf("Servers file %s changed, reloading servers", s.path)
+			onChange()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close has nothing to release for the file store
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// filter returns copies of the servers matching the predicate, so that callers can edit them freely
+func (s *fileStore) filter(match func(server *RPCServer) bool) []*RPCServer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var servers []*RPCServer
+	for _, server := range s.servers {
+		if match(server) {
+			copied := *server
+			servers = append(servers, &copied)
+		}
+	}
+
+	return servers
+}
+
+// update edits the server with the given id and saves the file
+func (s *fileStore) update(id int, edit func(existing *RPCServer)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.servers {
+		if existing.ID == id {
+			edit(existing)
+			return s.save()
+		}
+	}
+
+	return fmt.Errorf("failed to update server %d: not found", id)
+}
+
+// isYAML returns true if the file must be read and written as YAML (otherwise JSON)
+func (s *fileStore) isYAML() bool {
+	ext := strings.ToLower(filepath.Ext(s.path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// load reads the servers from the file
+func (s *fileStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Servers file %s does not exist, starting without servers", s.path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read servers file: %v", err)
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read servers file: %v", err)
+	}
+
+	// YAML is converted to JSON, so that both formats share the same field names
+	if s.isYAML() {
+		var content interface{}
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			return fmt.Errorf("failed to parse servers file: %v", err)
+		}
+		if data, err = json.Marshal(content); err != nil {
+			return fmt.Errorf("failed to parse servers file: %v", err)
+		}
+	}
+
+	var file serversFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse servers file: %v", err)
+	}
+
+	// Files written before the admin and health states only have is_active (and omitting it meant active)
+	var legacy struct {
+		Servers []struct {
+			IsActive *bool `json:"is_active"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to parse servers file: %v", err)
+	}
+
+	ids := make(map[int]bool)
+	urls := make(map[string]bool)
+	for i, server := range file.Servers {
+		if server.ID <= 0 || ids[server.ID] {
+			return fmt.Errorf("invalid servers file: server ids must be positive and unique (%d)", server.ID)
+		}
+		if server.URL == "" || urls[server.URL] {
+			return fmt.Errorf("invalid servers file: server urls must be set and unique (%s)", server.URL)
+		}
+		if server.RateLimit <= 0 || server.BurstLimit <= 0 {
+			return fmt.Errorf("invalid servers file: server %d limits must be positive", server.ID)
+		}
+		if server.AdminState != "" {
+			if _, err := ParseAdminState(string(server.AdminState)); err != nil {
+				return fmt.Errorf("invalid servers file: server %d: %v", server.ID, err)
+			}
+		}
+		if _, err := server.TLS.config(); err != nil {
+			return fmt.Errorf("invalid servers file: server %d: %v", server.ID, err)
+		}
+		if err := server.Auth.validate(); err != nil {
+			return fmt.Errorf("invalid servers file: server %d: %v", server.ID, err)
+		}
+		// An inactive server of a file written before the states was set inactive by the balancer
+		if isActive := legacy.Servers[i].IsActive; server.AdminState == "" && server.HealthState == "" && isActive != nil && !*isActive {
+			server.HealthState = HealthUnhealthy
+			server.HealthReason = "migrated from is_active = false"
+		}
+		server.normalizeStates()
+		ids[server.ID] = true
+		urls[server.URL] = true
+	}
+
+	s.mutex.Lock()
+	s.servers = file.Servers
+	s.modTime = info.ModTime()
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// save writes the servers to the file (through a temporary file, so that the file is never partially written). Must be called with the mutex held
+func (s *fileStore) save() error {
+	data, err := json.MarshalIndent(serversFile{Servers: s.servers}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to save servers file: %v", err)
+	}
+
+	if s.isYAML() {
+		var content interface{}
+		if err := json.Unmarshal(data, &content); err != nil {
+			return fmt.Errorf("failed to save servers file: %v", err)
+		}
+		if data, err = yaml.Marshal(content); err != nil {
+			return fmt.Errorf("failed to save servers file: %v", err)
+		}
+	}
+
+	// Only readable by the balancer: the file holds the credentials and TLS client keys of the servers, in plain text
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save servers file: %v", err)
+	}
+	// WriteFile keeps the permissions of a temporary file left by a previous run
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return fmt.Errorf("failed to save servers file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save servers file: %v", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+
+	return nil
+}
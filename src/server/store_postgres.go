@@ -0,0 +1,527 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Columns of the servers table, in the order read by scanServers
+const serverColumns = "id, url, rate_limit, burst_limit, admin_state, admin_reason, admin_changed_at, health_state, health_reason, health_changed_at, draining, created_at, updated_at, " +
+	"tls_ca_cert, tls_client_cert, tls_client_key, tls_server_name, tls_insecure_skip_verify, " +
+	"auth_header_name, auth_header_value, auth_query_param, auth_query_value, auth_username, auth_password"
+
+// postgresStore stores the servers in the loadbalancer.servers table
+type postgresStore struct {
+	db          *sql.DB
+	postgresURL string
+	// Encrypts the secrets of the servers (nil without key)
+	secrets     *secretBox
+}
+
+// newPostgresStore connects to the database, the secrets of the servers are encrypted with the key
+func newPostgresStore(postgresURL string, secretsKey []byte) (*postgresStore, error) {
+	secrets, err := newSecretBox(secretsKey)
+	if err != nil {
+		return nil, err
+	}
+	if secrets == nil {
+		log.Printf("SERVER_SECRETS_KEY is not set: the credentials and TLS client keys of the servers are stored in plain text")
+	}
+
+
+	// Connect to PostgreSQL
+	db, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping postgres: %v", err)
+	}
+
+	return &postgresStore{
+		db:          db,
+		postgresURL: postgresURL,
+		secrets:     secrets,
+	}, nil
+}
+
+// GetActiveServers retrieves all active servers (enabled, and not unhealthy) from the database
+func (s *postgresStore) GetActiveServers(ctx context.Context) ([]*RPCServer, error) {
+	query := `
+		SELECT ` + serverColumns + `
+		FROM servers
+		WHERE admin_state = 'enabled' AND health_state <> 'unhealthy'
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active servers: %v", err)
+	}
+	defer rows.Close()
+
+	return s.scanServers(rows)
+}
+
+// GetServers retrieves all the servers (active or not) from the database
+func (s *postgresStore) GetServers(ctx context.Context) ([]*RPCServer, error) {
+	query := `
+		SELECT ` + serverColumns + `
+		FROM servers
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query servers: %v", err)
+	}
+	defer rows.Close()
+
+	return s.scanServers(rows)
+}
+
+// GetServer retrieves a server by id, returns nil if it does not exist
+func (s *postgresStore) GetServer(ctx context.Context, id int) (*RPCServer, error) {
+	query := `
+		SELECT ` + serverColumns + `
+		FROM servers
+		WHERE id = $1
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server %d: %v", id, err)
+	}
+	defer rows.Close()
+
+	return s.readServer(rows)
+}
+
+// GetServerByURL retrieves a server by URL, returns nil if it does not exist
+func (s *postgresStore) GetServerByURL(ctx context.Context, url string) (*RPCServer, error) {
+	query := `
+		SELECT ` + serverColumns + `
+		FROM servers
+		WHERE url = $1
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server %s: %v", url, err)
+	}
+	defer rows.Close()
+
+	return s.readServer(rows)
+}
+
+// CreateServer inserts a new server in the database, and sets its id and timestamps
+func (s *postgresStore) CreateServer(ctx context.Context, server *RPCServer) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO servers (url, rate_limit, burst_limit, admin_state, admin_reason, draining)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, health_state, admin_changed_at, health_changed_at, created_at, updated_at
+	`
+
+	server.normalizeStates()
+	err = tx.QueryRowContext(ctx, query, server.URL, server.RateLimit, server.BurstLimit, server.AdminState, server.AdminReason, server.Draining).
+		Scan(&server.ID, &server.HealthState, &server.AdminChangedAt, &server.HealthChangedAt, &server.CreatedAt, &server.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+	server.updateIsActive()
+
+	// The secrets are encrypted with the id of the server, they are set once it is inserted
+	settings, err := s.settingsColumns(server)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+	query = `
+		UPDATE servers
+		SET tls_ca_cert = $1, tls_client_cert = $2, tls_client_key = $3, tls_server_name = $4, tls_insecure_skip_verify = $5,
+			auth_header_name = $6, auth_header_value = $7, auth_query_param = $8, auth_query_value = $9, auth_username = $10, auth_password = $11
+		WHERE id = $12
+	`
+	if _, err := tx.ExecContext(ctx, query, append(settings, server.ID)...); err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateServer saves the url, limits, admin state and draining of a server in the database (the health is kept)
+func (s *postgresStore) UpdateServer(ctx context.Context, server *RPCServer) error {
+	query := `
+		UPDATE servers
+		SET url = $1, rate_limit = $2, burst_limit = $3,
+			admin_changed_at = CASE WHEN admin_state <> $4 THEN CURRENT_TIMESTAMP ELSE admin_changed_at END,
+			admin_state = $4, admin_reason = $5, draining = $6,
+			tls_ca_cert = $7, tls_client_cert = $8, tls_client_key = $9, tls_server_name = $10, tls_insecure_skip_verify = $11,
+			auth_header_name = $12, auth_header_value = $13, auth_query_param = $14, auth_query_value = $15, auth_username = $16, auth_password = $17,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $18
+		RETURNING ` + serverColumns + `
+	`
+
+	settings, err := s.settingsColumns(server)
+	if err != nil {
+		return fmt.Errorf("failed to update server %d: %v", server.ID, err)
+	}
+	args := append([]any{server.URL, server.RateLimit, server.BurstLimit, server.AdminState, server.AdminReason, server.Draining}, settings...)
+	rows, err := s.db.QueryContext(ctx, query, append(args, server.ID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update server %d: %v", server.ID, err)
+	}
+	defer rows.Close()
+
+	updated, err := s.readServer(rows)
+	if err != nil {
+		return fmt.Errorf("failed to update server %d: %v", server.ID, err)
+	}
+	if updated == nil {
+		return fmt.Errorf("failed to update server %d: not found", server.ID)
+	}
+	*server = *updated
+
+	return nil
+}
+
+// DeleteServer removes a server from the database
+func (s *postgresStore) DeleteServer(ctx context.Context, id int) error {
+	query := `
+		DELETE FROM servers
+		WHERE id = $1
+	`
+
+	if _, err := s.db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to delete server %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// GetServersToCheck retrieves the servers whose health is unhealthy or unknown (checked by the health check)
+func (s *postgresStore) GetServersToCheck(ctx context.Context) ([]*RPCServer, error) {
+	query := `
+		SELECT ` + serverColumns + `
+		FROM servers
+		WHERE health_state <> 'healthy'
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query servers to check: %v", err)
+	}
+	defer rows.Close()
+
+	return s.scanServers(rows)
+}
+
+// SetServerHealth sets the health of a server, with the reason of the change
+func (s *postgresStore) SetServerHealth(ctx context.Context, id int, state HealthState, reason string) error {
+	query := `
+		UPDATE servers
+		SET health_state = $1, health_reason = $2, health_changed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`
+
+	if _, err := s.db.ExecContext(ctx, query, state, reason, id); err != nil {
+		return fmt.Errorf("failed to update server %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// SetServerAdminState enables or disables a server, with the reason of the change
+func (s *postgresStore) SetServerAdminState(ctx context.Context, id int, state AdminState, reason string) error {
+	query := `
+		UPDATE servers
+		SET admin_state = $1, admin_reason = $2, admin_changed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`
+
+	if _, err := s.db.ExecContext(ctx, query, state, reason, id); err != nil {
+		return fmt.Errorf("failed to update server %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// SetServerDraining sets whether a server is draining
+func (s *postgresStore) SetServerDraining(ctx context.Context, id int, draining bool) error {
+	query := `
+		UPDATE servers
+		SET draining = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`
+
+	if _, err := s.db.ExecContext(ctx, query, draining, id); err != nil {
+		return fmt.Errorf("failed to update server %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// AddServerEvent records a change of the state of a server in the database
+func (s *postgresStore) AddServerEvent(ctx context.Context, event *ServerEvent) error {
+	query := `
+		INSERT INTO server_events (server_id, type, from_state, to_state, reason, actor)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	err := s.db.QueryRowContext(ctx, query, event.ServerID, event.Type, event.FromState, event.ToState, event.Reason, event.Actor).
+		Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add server event: %v", err)
+	}
+
+	return nil
+}
+
+// GetServerEvents retrieves the latest events of a server, most recent first
+func (s *postgresStore) GetServerEvents(ctx context.Context, serverID int, limit int) ([]*ServerEvent, error) {
+	query := `
+		SELECT id, server_id, type, from_state, to_state, reason, actor, created_at
+		FROM server_events
+		WHERE server_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, serverID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events of server %d: %v", serverID, err)
+	}
+	defer rows.Close()
+
+	var events []*ServerEvent
+	for rows.Next() {
+		event := &ServerEvent{}
+		err := rows.Scan(&event.ID, &event.ServerID, &event.Type, &event.FromState, &event.ToState, &event.Reason, &event.Actor, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan server event row: %v", err)
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// SaveSLARollups saves the daily SLA summaries of the servers in the database, in a single transaction. Each replica replaces its own rows only
+func (s *postgresStore) SaveSLARollups(ctx context.Context, rollups []*SLARollup) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save SLA rollups: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO server_sla_daily (server_id, day, replica, requests, errors, rate_limited, probes, probe_failures, latency_buckets, latency_p50_ms, latency_p95_ms, latency_p99_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (server_id, day, replica) DO UPDATE
+		SET requests = EXCLUDED.requests, errors = EXCLUDED.errors, rate_limited = EXCLUDED.rate_limited,
+			probes = EXCLUDED.probes, probe_failures = EXCLUDED.probe_failures, latency_buckets = EXCLUDED.latency_buckets,
+			latency_p50_ms = EXCLUDED.latency_p50_ms, latency_p95_ms = EXCLUDED.latency_p95_ms, latency_p99_ms = EXCLUDED.latency_p99_ms,
+			updated_at = CURRENT_TIMESTAMP
+	`
+
+	for _, rollup := range rollups {
+		_, err := tx.ExecContext(ctx, query, rollup.ServerID, rollup.Day, rollup.Replica, rollup.Requests, rollup.Errors, rollup.RateLimited,
+			rollup.Probes, rollup.ProbeFailures, pq.Array(rollup.Latency), rollup.LatencyP50, rollup.LatencyP95, rollup.LatencyP99)
+		if err != nil {
+			return fmt.Errorf("failed to save SLA rollup of server %d: %v", rollup.ServerID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetSLARollups retrieves the daily SLA summaries of all the replicas since the given time from the database
+func (s *postgresStore) GetSLARollups(ctx context.Context, since time.Time) ([]*SLARollup, error) {
+	query := `
+		SELECT server_id, day, replica, requests, errors, rate_limited, probes, probe_failures, latency_buckets, latency_p50_ms, latency_p95_ms, latency_p99_ms
+		FROM server_sla_daily
+		WHERE day >= $1::date
+		ORDER BY day ASC, server_id ASC, replica ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SLA rollups: %v", err)
+	}
+	defer rows.Close()
+
+	var rollups []*SLARollup
+	for rows.Next() {
+		rollup := &SLARollup{}
+		err := rows.Scan(&rollup.ServerID, &rollup.Day, &rollup.Replica, &rollup.Requests, &rollup.Errors, &rollup.RateLimited, &rollup.Probes,
+			&rollup.ProbeFailures, pq.Array(&rollup.Latency), &rollup.LatencyP50, &rollup.LatencyP95, &rollup.LatencyP99)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan SLA rollup row: %v", err)
+		}
+
+		rollups = append(rollups, rollup)
+	}
+
+	return rollups, rows.Err()
+}
+
+// Close closes the database connections
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+// scanServers reads the servers returned by a query, and decrypts their secrets. The servers whose secrets cannot be decrypted (key missing or changed)
+// are skipped and logged: they are not routed to without their credentials, and the other servers still are
+func (s *postgresStore) scanServers(rows *sql.Rows) ([]*RPCServer, error) {
+	var servers []*RPCServer
+
+	// Add an index to the servers (to ensure deterministic order, since the database doesn't guarantee it)
+	for rows.Next() {
+		server, err := s.scanServer(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.openSecrets(server); err != nil {
+			log.Printf("Skipping server %d (%s): %v", server.ID, server.URL, err)
+			continue
+		}
+
+		servers = append(servers, server)
+	}
+
+	return servers, rows.Err()
+}
+
+// readServer reads the server returned by a query (nil if none). Unlike scanServers, a server whose secrets cannot be decrypted is an error, reported to the admin
+func (s *postgresStore) readServer(rows *sql.Rows) (*RPCServer, error) {
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	server, err := s.scanServer(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.openSecrets(server); err != nil {
+		return nil, fmt.Errorf("failed to read server %d: %v", server.ID, err)
+	}
+
+	return server, nil
+}
+
+// scanServer reads the current row of a query, with its secrets still encrypted
+func (s *postgresStore) scanServer(rows *sql.Rows) (*RPCServer, error) {
+	server := &RPCServer{TLS: &ServerTLS{}, Auth: &ServerAuth{}}
+	err := rows.Scan(
+		&server.ID,
+		&server.URL,
+		&server.RateLimit,
+		&server.BurstLimit,
+		&server.AdminState,
+		&server.AdminReason,
+		&server.AdminChangedAt,
+		&server.HealthState,
+		&server.HealthReason,
+		&server.HealthChangedAt,
+		&server.Draining,
+		&server.CreatedAt,
+		&server.UpdatedAt,
+		&server.TLS.CACert,
+		&server.TLS.ClientCert,
+		&server.TLS.ClientKey,
+		&server.TLS.ServerName,
+		&server.TLS.InsecureSkipVerify,
+		&server.Auth.HeaderName,
+		&server.Auth.HeaderValue,
+		&server.Auth.QueryParam,
+		&server.Auth.QueryValue,
+		&server.Auth.Username,
+		&server.Auth.Password,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan server row: %v", err)
+	}
+	server.updateIsActive()
+
+	return server, nil
+}
+
+// openSecrets decrypts the secrets of a scanned server, and removes its TLS and auth settings if empty
+func (s *postgresStore) openSecrets(server *RPCServer) error {
+	for _, secret := range secretColumns(server.TLS, server.Auth) {
+		value, err := s.secrets.open(secret.column, server.ID, *secret.value)
+		if err != nil {
+			return err
+		}
+		*secret.value = value
+	}
+	if server.TLS.isZero() {
+		server.TLS = nil
+	}
+	if server.Auth.isZero() {
+		server.Auth = nil
+	}
+
+	return nil
+}
+
+// settingsColumns returns the values of the TLS and auth columns of a server (empty without configuration), with the secrets encrypted
+func (s *postgresStore) settingsColumns(server *RPCServer) ([]any, error) {
+	settings := ServerTLS{}
+	if server.TLS != nil {
+		settings = *server.TLS
+	}
+	auth := ServerAuth{}
+	if server.Auth != nil {
+		auth = *server.Auth
+	}
+
+	for _, secret := range secretColumns(&settings, &auth) {
+		sealed, err := s.secrets.seal(secret.column, server.ID, *secret.value)
+		if err != nil {
+			return nil, err
+		}
+		*secret.value = sealed
+	}
+
+	return []any{
+		settings.CACert, settings.ClientCert, settings.ClientKey, settings.ServerName, settings.InsecureSkipVerify,
+		auth.HeaderName, auth.HeaderValue, auth.QueryParam, auth.QueryValue, auth.Username, auth.Password,
+	}, nil
+}
+
+// secretColumn is a column of the servers table holding a secret, encrypted in the database
+type secretColumn struct {
+	column string
+	value  *string
+}
+
+// secretColumns returns the secrets of the TLS and auth settings, with their columns
+func secretColumns(settings *ServerTLS, auth *ServerAuth) []secretColumn {
+	return []secretColumn{
+		{"tls_client_key", &settings.ClientKey},
+		{"auth_header_value", &auth.HeaderValue},
+		{"auth_query_value", &auth.QueryValue},
+		{"auth_password", &auth.Password},
+	}
+}
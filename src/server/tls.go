@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// Value replacing the secrets (TLS client key, credentials) in the responses of the admin API (sending it back keeps the stored secret)
+const REDACTED = "[redacted]"
+
+// ServerTLS is the TLS configuration used to connect to a node: private CA, client certificate (mTLS), SNI override
+type ServerTLS struct {
+	// PEM bundle of the CAs verifying the certificate of the node (the system CAs if empty)
+	CACert string `json:"ca_cert,omitempty"`
+	// PEM client certificate and key, for the nodes requiring mTLS
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// Server name sent in the SNI and verified in the certificate (the host of the URL if empty)
+	ServerName string `json:"server_name,omitempty"`
+	// Skips the verification of the certificate of the node, for development only
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// isZero returns true if nothing is configured (the defaults of the http package are used)
+func (t *ServerTLS) isZero() bool {
+	return t == nil || *t == ServerTLS{}
+}
+
+// equal returns true if both configurations are the same
+func (t *ServerTLS) equal(other *ServerTLS) bool {
+	if t.isZero() || other.isZero() {
+		return t.isZero() == other.isZero()
+	}
+	return *t == *other
+}
+
+// config builds the TLS configuration of the connections to the node, nil for the defaults
+func (t *ServerTLS) config() (*tls.Config, error) {
+	if t.isZero() {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.CACert)) {
+			return nil, fmt.Errorf("invalid tls ca_cert: no PEM certificate found")
+		}
+		config.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		certificate, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// redacted returns a copy of the configuration without the client key, to be displayed
+func (t *ServerTLS) redacted() *ServerTLS {
+	if t == nil {
+		return nil
+	}
+
+	copied := *t
+	if copied.ClientKey != "" {
+		copied.ClientKey = REDACTED
+	}
+	return &copied
+}
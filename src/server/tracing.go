@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// tracer creates the spans of the balancer (a no-op until tracing is set up)
+var tracer = otel.Tracer("load-balancer")
+
+// TracingConfig configures the export of the traces to an OpenTelemetry collector
+type TracingConfig struct {
+	// OTLP/HTTP endpoint of the collector, eg http://localhost:4318 (tracing is disabled if empty)
+	Endpoint    string
+	ServiceName string
+	// Fraction of the traces recorded (when the client did not already sample the request)
+	SampleRatio float64
+}
+
+// SetupTracing exports the spans to the collector, and propagates the W3C trace context to the nodes.
+// Returns a function flushing the pending spans, to call before exiting
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+
+	return setupTracerProvider(exporter, config), nil
+}
+
+// setupTracerProvider registers a tracer provider batching the spans to the exporter
+func setupTracerProvider(exporter sdktrace.SpanExporter, config TracingConfig) func(context.Context) error {
+	res := resource.NewSchemaless(semconv.ServiceName(config.ServiceName))
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"load-balancer/src/prometheus"
+)
+
+// TransportConfig tunes the connections to the nodes, each node has its own transport (and so its own connection pool)
+type TransportConfig struct {
+	// Idle connections kept open to each node, for reuse by the next requests
+	MaxIdleConns int
+	// Connections opened to each node at most, including the active ones (0 for no limit)
+	MaxConns int
+	// Time after which an idle connection is closed
+	IdleConnTimeout time.Duration
+	// Period of the TCP keep-alive probes of the connections
+	KeepAlive           time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Time to wait for the headers of the response once the request has been sent (0 for no limit)
+	ResponseHeaderTimeout time.Duration
+	// Negotiates HTTP/2 with the nodes supporting it (https only)
+	HTTP2 bool
+}
+
+// DefaultTransportConfig returns the transport configuration used when none is set, sized for the rates of the nodes (the http package keeps only 2 idle connections per host)
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          64,
+		IdleConnTimeout:       90 * time.Second,
+		KeepAlive:             30 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		HTTP2:                 true,
+	}
+}
+
+// newTransport creates the transport of the connections to a server, with its TLS configuration. The connections are reported to the pool, if any
+func newTransport(server *RPCServer, config TransportConfig, pool *connPool) (*http.Transport, error) {
+	tlsConfig, err := server.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAlive}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if pool != nil {
+		transport.DialContext = pool.dialContext(dialer)
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	// All the connections of the transport go to the same node
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConns
+	transport.MaxConnsPerHost = config.MaxConns
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	if !config.HTTP2 {
+		// A non-nil empty map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
+
+// newServerClient creates a client sending a few requests to a server (health check), with its TLS configuration
+func newServerClient(server *RPCServer, config TransportConfig, timeout time.Duration) (*http.Client, error) {
+	transport, err := newTransport(server, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Keep-alive is pointless for a single request, and would leave the connection open until the next health check
+	transport.DisableKeepAlives = true
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// connPool follows the connections opened to a node (the http package does not expose its pool), and reports how many are active or idle
+type connPool struct {
+	url   string
+	mutex sync.Mutex
+	// Open connections, by local address, with the number of requests using them (several with HTTP/2)
+	conns map[string]int
+	// The node has been removed, its remaining connections are not reported anymore
+	forgotten bool
+}
+
+// Pools of the nodes by URL, shared by the successive nodes of a server (their transports are recreated when the TLS configuration changes)
+var (
+	connPools      = make(map[string]*connPool)
+	connPoolsMutex sync.Mutex
+)
+
+// getConnPool returns the pool of the connections to a node
+func getConnPool(url string) *connPool {
+	connPoolsMutex.Lock()
+	defer connPoolsMutex.Unlock()
+
+	pool, ok := connPools[url]
+	if !ok {
+		pool = &connPool{url: url, conns: make(map[string]int)}
+		connPools[url] = pool
+	}
+	return pool
+}
+
+// forgetConnPool stops reporting the connections of a node that no longer exists
+func forgetConnPool(url string) {
+	connPoolsMutex.Lock()
+	pool, ok := connPools[url]
+	delete(connPools, url)
+	connPoolsMutex.Unlock()
+
+	if ok {
+		pool.mutex.Lock()
+		pool.forgotten = true
+		pool.mutex.Unlock()
+	}
+}
+
+// dialContext opens the connections of the transport with the dialer, and follows them until they are closed
+func (p *connPool) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		prometheus.UpstreamConnectionsOpened.WithLabelValues(p.url).Inc()
+
+		p.mutex.Lock()
+		p.conns[conn.LocalAddr().String()] = 0
+		p.report()
+		p.mutex.Unlock()
+
+		return &pooledConn{Conn: conn, pool: p}, nil
+	}
+}
+
+// track follows the connection used by the request sent with the returned context, until release is called
+func (p *connPool) track(ctx context.Context) (context.Context, func()) {
+	var key string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			// The connection may be wrapped (TLS), its local address identifies it
+			key = info.Conn.LocalAddr().String()
+			if requests, ok := p.conns[key]; ok {
+				p.conns[key] = requests + 1
+				p.report()
+			}
+		},
+	}
+
+	release := func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if requests, ok := p.conns[key]; ok && requests > 0 {
+			p.conns[key] = requests - 1
+			p.report()
+		}
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), release
+}
+
+// closed stops following a connection
+func (p *connPool) closed(conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.conns, conn.LocalAddr().String())
+	p.report()
+}
+
+// report sets the gauges of the connections, the mutex must be held
+func (p *connPool) report() {
+	if p.forgotten {
+		return
+	}
+
+	active := 0
+	for _, requests := range p.conns {
+		if requests > 0 {
+			active++
+		}
+	}
+	prometheus.UpstreamConnections.WithLabelValues(p.url, "active").Set(float64(active))
+	prometheus.UpstreamConnections.WithLabelValues(p.url, "idle").Set(float64(len(p.conns) - active))
+}
+
+// pooledConn is a connection followed by its pool
+type pooledConn struct {
+	net.Conn
+	pool *connPool
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() { c.pool.closed(c.Conn) })
+	return c.Conn.Close()
+}
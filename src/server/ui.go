@@ -0,0 +1,17 @@
+package server
+
+import (
+	"embed"
+	"net/http"
+)
+
+// Status dashboard, embedded in the binary (no external resources)
+//
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// HandleUI serves the status dashboard, which polls the stats and admin APIs (node states, traffic distribution, recent errors, enable/disable/drain buttons)
+func (b *Balancer) HandleUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFileFS(w, r, uiFiles, "ui/index.html")
+}
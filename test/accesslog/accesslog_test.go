@@ -0,0 +1,101 @@
+package accesslog
+
+// Tests of the access log: the client address is read from X-Real-IP only behind a trusted proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"load-balancer/src/server"
+)
+
+func TestClientIP(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(node.Close)
+
+	dir := t.TempDir()
+	serversFile := filepath.Join(dir, "servers.json")
+	if err := os.WriteFile(serversFile, []byte(`{"servers":[{"id":1,"url":"`+node.URL+`","rate_limit":100,"burst_limit":100}]}`), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	logFile := filepath.Join(dir, "access.log")
+	accessLog, err := server.NewAccessLogger(server.AccessLogConfig{
+		Output:         "file",
+		File:           logFile,
+		SampleRatio:    1,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	if err != nil {
+		t.Fatalf("failed to create access logger: %v", err)
+	}
+	balancer := &server.Balancer{ServerManager: serverManager, ReverseProxy: true, AccessLog: accessLog}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"trusted proxy", "10.1.2.3:4000", "203.0.113.7", "203.0.113.7"},
+		{"untrusted client", "198.51.100.1:4000", "203.0.113.7", "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:4000", "", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`))
+		request.RemoteAddr = test.remoteAddr
+		if test.realIP != "" {
+			request.Header.Set("X-Real-IP", test.realIP)
+		}
+		balancer.HandleRequest(httptest.NewRecorder(), request)
+	}
+	if err := accessLog.Close(); err != nil {
+		t.Fatalf("failed to close access log: %v", err)
+	}
+
+	file, err := os.Open(logFile)
+	if err != nil {
+		t.Fatalf("failed to open access log: %v", err)
+	}
+	defer file.Close()
+
+	var clientIPs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line struct {
+			ClientIP string `json:"client_ip"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid access log line %q: %v", scanner.Text(), err)
+		}
+		clientIPs = append(clientIPs, line.ClientIP)
+	}
+
+	if len(clientIPs) != len(tests) {
+		t.Fatalf("%d access log lines, want %d", len(clientIPs), len(tests))
+	}
+	for i, test := range tests {
+		if clientIPs[i] != test.want {
+			t.Errorf("%s: client_ip = %q, want %q", test.name, clientIPs[i], test.want)
+		}
+	}
+}
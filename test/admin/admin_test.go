@@ -0,0 +1,172 @@
+package admin
+
+// Tests of the secrets of the servers: never returned by the admin API, and saved in a file readable by the balancer only
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// Secrets of the server, none of them must appear in a response
+const (
+	headerValue = "header-secret"
+	queryValue  = "query-secret"
+	password    = "password-secret"
+)
+
+// newClientCertificate generates a self-signed client certificate and its key (PEM)
+func newClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "load-balancer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return string(cert), string(keyPEM)
+}
+
+// newBalancer creates a balancer whose file store holds a server with credentials and a TLS client certificate.
+// Returns the client key of the server and the servers file, created readable by everyone
+func newBalancer(t *testing.T) (*server.Balancer, string, string) {
+	t.Helper()
+
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(node.Close)
+
+	cert, key := newClientCertificate(t)
+	servers := map[string]any{
+		"servers": []map[string]any{{
+			"id":          1,
+			"url":         node.URL,
+			"rate_limit":  10,
+			"burst_limit": 5,
+			"tls":         map[string]any{"client_cert": cert, "client_key": key},
+			"auth": map[string]any{
+				"header_name": "x-api-key", "header_value": headerValue,
+				"query_param": "apikey", "query_value": queryValue,
+				"username": "user", "password": password,
+			},
+		}},
+	}
+	data, err := json.Marshal(servers)
+	if err != nil {
+		t.Fatalf("failed to marshal servers: %v", err)
+	}
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(serversFile, data, 0644); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	return &server.Balancer{ServerManager: serverManager}, key, serversFile
+}
+
+func TestStateResponsesAreRedacted(t *testing.T) {
+	balancer, clientKey, _ := newBalancer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/servers/{id}/drain", balancer.HandleDrainServer)
+	mux.HandleFunc("POST /admin/servers/{id}/undrain", balancer.HandleUndrainServer)
+	mux.HandleFunc("POST /admin/servers/{id}/disable", balancer.HandleDisableServer)
+	mux.HandleFunc("POST /admin/servers/{id}/enable", balancer.HandleEnableServer)
+
+	for _, action := range []string{"drain", "undrain", "disable", "enable"} {
+		t.Run(action, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/servers/1/"+action, nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+			}
+
+			body := recorder.Body.String()
+			for _, secret := range []string{headerValue, queryValue, password, clientKey} {
+				if strings.Contains(body, secret) {
+					t.Errorf("response leaks a secret: %s", body)
+				}
+			}
+
+			var response struct {
+				TLS  map[string]any `json:"tls"`
+				Auth map[string]any `json:"auth"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if response.TLS["client_key"] != "[redacted]" {
+				t.Errorf("tls client_key = %v, want [redacted]", response.TLS["client_key"])
+			}
+			for _, field := range []string{"header_value", "query_value", "password"} {
+				if response.Auth[field] != "[redacted]" {
+					t.Errorf("auth %s = %v, want [redacted]", field, response.Auth[field])
+				}
+			}
+			if response.Auth["header_name"] != "x-api-key" || response.Auth["username"] != "user" {
+				t.Errorf("auth names must be kept: %v", response.Auth)
+			}
+		})
+	}
+}
+
+func TestServersFileIsPrivate(t *testing.T) {
+	balancer, _, serversFile := newBalancer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/servers/{id}/drain", balancer.HandleDrainServer)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/servers/1/drain", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The saved file holds the secrets in plain text
+	info, err := os.Stat(serversFile)
+	if err != nil {
+		t.Fatalf("failed to stat servers file: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("servers file mode = %o, want 600", mode)
+	}
+}
@@ -0,0 +1,61 @@
+package admin
+
+// Tests of the admin authentication: the Basic credentials cached by the browsers cannot be used by other sites to change a state
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"load-balancer/src/server"
+)
+
+func TestAdminAuth(t *testing.T) {
+	const adminKey = "admin-key"
+
+	tests := []struct {
+		name    string
+		method  string
+		basic   string
+		bearer  string
+		headers map[string]string
+		want    int
+	}{
+		{"cross-site POST with Basic", http.MethodPost, adminKey, "", map[string]string{"Origin": "https://evil.example", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"POST with Basic without X-Requested-With", http.MethodPost, adminKey, "", nil, http.StatusForbidden},
+		{"cross-site POST with Basic and X-Requested-With", http.MethodPost, adminKey, "", map[string]string{"X-Requested-With": "fetch", "Origin": "https://evil.example"}, http.StatusForbidden},
+		{"cross-site fetch metadata", http.MethodPost, adminKey, "", map[string]string{"X-Requested-With": "fetch", "Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"dashboard POST with Basic", http.MethodPost, adminKey, "", map[string]string{"X-Requested-With": "fetch", "Origin": "http://lb.example", "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"GET with Basic", http.MethodGet, adminKey, "", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+		{"POST with Bearer", http.MethodPost, "", adminKey, nil, http.StatusOK},
+		{"wrong Basic password", http.MethodGet, "wrong", "", nil, http.StatusUnauthorized},
+		{"wrong Bearer token", http.MethodPost, "", "wrong", nil, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			handler := server.AdminAuth(adminKey, func(w http.ResponseWriter, r *http.Request) { called = true })
+
+			request := httptest.NewRequest(test.method, "http://lb.example/admin/servers/1/disable", nil)
+			if test.basic != "" {
+				request.SetBasicAuth("admin", test.basic)
+			}
+			if test.bearer != "" {
+				request.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.want, recorder.Body.String())
+			}
+			if called != (test.want == http.StatusOK) {
+				t.Errorf("handler called = %v with status %d", called, recorder.Code)
+			}
+		})
+	}
+}
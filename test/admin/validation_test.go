@@ -0,0 +1,52 @@
+package admin
+
+// Tests of the validation of the servers created with the admin API
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateServerValidation(t *testing.T) {
+	balancer, _, _ := newBalancer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/servers", balancer.HandleCreateServer)
+	create := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/servers", strings.NewReader(body)))
+		return recorder
+	}
+
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(node.Close)
+	if recorder := create(`{"url":"` + node.URL + `","rate_limit":1,"burst_limit":1}`); recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Nothing listens on the port of a closed server
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"empty URL", "", http.StatusBadRequest},
+		{"bad scheme", "ftp://127.0.0.1/", http.StatusBadRequest},
+		{"no host", "http://", http.StatusBadRequest},
+		{"duplicate", node.URL, http.StatusConflict},
+		{"unreachable", closed.URL, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := create(`{"url":"` + test.url + `","rate_limit":1,"burst_limit":1}`)
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.want, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package admission
+
+// Tests of the admission control: shedding of the lower priorities when the queues are full, timeout of the queued requests, and clients going away
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// acquire queues a request in the background, its result is sent to the returned channel
+func acquire(ctx context.Context, admission *server.Admission, p server.Priority) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- admission.Acquire(ctx, p) }()
+	return result
+}
+
+// waitQueued waits until the given number of requests are queued
+func waitQueued(t *testing.T, admission *server.Admission, queued int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for admission.Queued() != queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", admission.Queued(), queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// result waits for the result of a queued request
+func result(t *testing.T, acquired <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-acquired:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still waiting")
+		return nil
+	}
+}
+
+func TestAdmissionShedsLowerPriorities(t *testing.T) {
+	admission := server.NewAdmission(1, 2, time.Minute)
+	ctx := context.Background()
+
+	if err := admission.Acquire(ctx, server.PriorityNormal); err != nil {
+		t.Fatalf("first request not admitted: %v", err)
+	}
+
+	// The queue is full of low priority requests
+	firstLow := acquire(ctx, admission, server.PriorityLow)
+	waitQueued(t, admission, 1)
+	lastLow := acquire(ctx, admission, server.PriorityLow)
+	waitQueued(t, admission, 2)
+
+	// A high priority request takes the place of the most recent low priority one
+	high := acquire(ctx, admission, server.PriorityHigh)
+	if err := result(t, lastLow); !errors.Is(err, server.ErrShed) {
+		t.Fatalf("last low priority request: %v, want it shed", err)
+	}
+	waitQueued(t, admission, 2)
+
+	// Nothing lower to shed: the request is shed right away
+	if err := admission.Acquire(ctx, server.PriorityLow); !errors.Is(err, server.ErrShed) {
+		t.Fatalf("low priority request on full queues: %v, want it shed", err)
+	}
+
+	// The slots go to the high priority request first
+	admission.Release()
+	if err := result(t, high); err != nil {
+		t.Fatalf("high priority request not admitted: %v", err)
+	}
+	select {
+	case err := <-firstLow:
+		t.Fatalf("low priority request admitted before the high priority one (%v)", err)
+	default:
+	}
+
+	admission.Release()
+	if err := result(t, firstLow); err != nil {
+		t.Fatalf("first low priority request not admitted: %v", err)
+	}
+	admission.Release()
+
+	if inFlight, queued := admission.InFlight(), admission.Queued(); inFlight != 0 || queued != 0 {
+		t.Errorf("%d requests in flight and %d queued, want none", inFlight, queued)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	admission := server.NewAdmission(1, 10, 50*time.Millisecond)
+	ctx := context.Background()
+
+	if err := admission.Acquire(ctx, server.PriorityNormal); err != nil {
+		t.Fatalf("first request not admitted: %v", err)
+	}
+
+	start := time.Now()
+	if err := admission.Acquire(ctx, server.PriorityHigh); !errors.Is(err, server.ErrShed) {
+		t.Fatalf("queued request: %v, want it shed after the timeout", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("request shed after %v, want it to wait for the timeout (50ms)", waited)
+	}
+	if queued := admission.Queued(); queued != 0 {
+		t.Errorf("%d requests queued, want the timed out one removed", queued)
+	}
+
+	admission.Release()
+	if inFlight := admission.InFlight(); inFlight != 0 {
+		t.Errorf("%d requests in flight, want none", inFlight)
+	}
+}
+
+func TestAdmissionClientCancellation(t *testing.T) {
+	admission := server.NewAdmission(1, 10, time.Minute)
+
+	if err := admission.Acquire(context.Background(), server.PriorityNormal); err != nil {
+		t.Fatalf("first request not admitted: %v", err)
+	}
+
+	// The client of the queued request goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := acquire(ctx, admission, server.PriorityNormal)
+	waitQueued(t, admission, 1)
+	cancel()
+	if err := result(t, queued); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request: %v, want context.Canceled", err)
+	}
+	waitQueued(t, admission, 0)
+
+	// Its slot is not kept once the first request is done
+	admission.Release()
+	if inFlight := admission.InFlight(); inFlight != 0 {
+		t.Errorf("%d requests in flight, want none", inFlight)
+	}
+}
@@ -0,0 +1,183 @@
+package backoff
+
+// Tests of the nodes answering 429 (paused, the request retried on another node) and of the rate limit headers of the providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// newBalancer creates a balancer routing to the given node URLs (ids 1, 2, ...), with the rate and burst limits
+func newBalancer(t *testing.T, rateLimit, burstLimit int, urls ...string) *server.Balancer {
+	t.Helper()
+
+	var servers []string
+	for i, url := range urls {
+		servers = append(servers, fmt.Sprintf(`{"id":%d,"url":"%s","rate_limit":%d,"burst_limit":%d}`, i+1, url, rateLimit, burstLimit))
+	}
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(serversFile, []byte(`{"servers":[`+strings.Join(servers, ",")+`]}`), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	return &server.Balancer{ServerManager: serverManager, ReverseProxy: true}
+}
+
+// newNode starts a node answering with the status and headers returned by respond
+func newNode(t *testing.T, respond func(header http.Header) int) *httptest.Server {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(respond(w.Header()))
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(node.Close)
+	return node
+}
+
+// send proxies a request, and returns the status of the response
+func send(balancer *server.Balancer) int {
+	recorder := httptest.NewRecorder()
+	balancer.HandleRequest(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`)))
+	return recorder.Code
+}
+
+// nodeStats returns the stats of a node
+func nodeStats(t *testing.T, balancer *server.Balancer, id int) server.NodeStats {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	balancer.HandleStats(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/stats?node=%d", id), nil))
+	var stats server.Stats
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil || len(stats.Nodes) != 1 {
+		t.Fatalf("invalid stats of node %d (%v): %s", id, err, recorder.Body.String())
+	}
+	return stats.Nodes[0]
+}
+
+func TestRateLimitedNodeIsPausedAndRetried(t *testing.T) {
+	var limitedCalls atomic.Int32
+	limited := newNode(t, func(header http.Header) int {
+		limitedCalls.Add(1)
+		header.Set("Retry-After", "30")
+		return http.StatusTooManyRequests
+	})
+	healthy := newNode(t, func(header http.Header) int { return http.StatusOK })
+	balancer := newBalancer(t, 100, 100, limited.URL, healthy.URL)
+
+	// The request answered 429 is retried on the other node, and the limited node is skipped while paused
+	for i := 0; i < 5; i++ {
+		if status := send(balancer); status != http.StatusOK {
+			t.Fatalf("status = %d, want 200", status)
+		}
+	}
+	if calls := limitedCalls.Load(); calls != 1 {
+		t.Errorf("the rate limited node received %d requests, want 1", calls)
+	}
+
+	paused := nodeStats(t, balancer, 1).PausedUntil
+	if paused == nil || time.Until(*paused) < 25*time.Second {
+		t.Errorf("node paused until %v, want about 30s from now", paused)
+	}
+}
+
+func TestRateLimitHeadersTuneTheNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		// Rate the node is lowered to, 0 if it keeps its configured rate (100)
+		want float64
+	}{
+		{"limit without window", map[string]string{"X-RateLimit-Limit": "1"}, 0},
+		{"policy window", map[string]string{"X-RateLimit-Limit": "60", "RateLimit-Policy": "60;w=60"}, 1},
+		{"inline policy", map[string]string{"RateLimit-Limit": "10, 10;w=5"}, 2},
+		{"window until the reset", map[string]string{"X-RateLimit-Limit": "5", "X-RateLimit-Reset": "10"}, 0.5},
+		{"limit above the configured rate", map[string]string{"X-RateLimit-Limit": "1000", "RateLimit-Policy": "1000;w=1"}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newNode(t, func(header http.Header) int {
+				for name, value := range test.headers {
+					header.Set(name, value)
+				}
+				return http.StatusOK
+			})
+			balancer := newBalancer(t, 100, 100, node.URL)
+
+			if status := send(balancer); status != http.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+
+			stats := nodeStats(t, balancer, 1)
+			if test.want == 0 {
+				if stats.ProviderRateLimit != nil {
+					t.Errorf("rate lowered to %v, want the configured rate", *stats.ProviderRateLimit)
+				}
+				return
+			}
+			if stats.ProviderRateLimit == nil || *stats.ProviderRateLimit != test.want {
+				t.Errorf("rate lowered to %v, want %v", stats.ProviderRateLimit, test.want)
+			}
+		})
+	}
+}
+
+func TestTunedRateLimitExpires(t *testing.T) {
+	// The provider allows one request per second, it only says so in its first response
+	var calls atomic.Int32
+	node := newNode(t, func(header http.Header) int {
+		if calls.Add(1) == 1 {
+			header.Set("X-RateLimit-Limit", "1")
+			header.Set("RateLimit-Policy", "1;w=1")
+		}
+		return http.StatusOK
+	})
+	balancer := newBalancer(t, 1000, 1, node.URL)
+
+	if status := send(balancer); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	// Lowered to 1 request per second, the limiter has no token left (but the one refilled at the configured rate while the first request was served)
+	served := 0
+	for i := 0; i < 3; i++ {
+		if send(balancer) == http.StatusOK {
+			served++
+		}
+	}
+	if served > 1 {
+		t.Fatalf("%d requests of 3 served, want at most 1 while the rate is lowered", served)
+	}
+
+	// Once the window ended, the configured rate (1000 per second) is restored: a token is back within milliseconds
+	time.Sleep(1100 * time.Millisecond)
+	if status := send(balancer); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if status := send(balancer); status != http.StatusOK {
+		t.Errorf("status = %d, want 200 once the configured rate is restored", status)
+	}
+	if rate := nodeStats(t, balancer, 1).ProviderRateLimit; rate != nil {
+		t.Errorf("rate lowered to %v, want the configured rate", *rate)
+	}
+}
@@ -0,0 +1,78 @@
+package balancer
+
+// Tests of the balancer under concurrent requests, health changes and stats reads (meant to be run with -race)
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"load-balancer/src/server"
+)
+
+func TestConcurrentHealthChanges(t *testing.T) {
+	// Node 1 answers 403 to some requests, which sets it unhealthy while other requests are routed to it
+	var calls atomic.Int32
+	forbidding := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%10 == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(forbidding.Close)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(healthy.Close)
+
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	servers := `{"servers":[
+		{"id":1,"url":"` + forbidding.URL + `","rate_limit":100000,"burst_limit":100000},
+		{"id":2,"url":"` + healthy.URL + `","rate_limit":100000,"burst_limit":100000}]}`
+	if err := os.WriteFile(serversFile, []byte(servers), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+	balancer := &server.Balancer{ServerManager: serverManager, ReverseProxy: true}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`))
+				balancer.HandleRequest(httptest.NewRecorder(), request)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				balancer.HandleStats(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The 403 took node 1 out of rotation, the requests go to node 2
+	recorder := httptest.NewRecorder()
+	balancer.HandleRequest(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+}
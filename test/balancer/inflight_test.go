@@ -0,0 +1,140 @@
+package balancer
+
+// Tests of the concurrency limit of the nodes: the slot of a request is released however it ends
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// slowNodeBalancer creates a balancer routing to a node answering with the given status once unblocked (or once the request is cancelled)
+func slowNodeBalancer(t *testing.T, status int) (*server.Balancer, chan struct{}) {
+	unblock := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The context of the request is only cancelled when the client goes away once the body has been read
+		io.ReadAll(r.Body)
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(node.Close)
+
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	servers := `{"servers":[{"id":1,"url":"` + node.URL + `","rate_limit":100,"burst_limit":100}]}`
+	if err := os.WriteFile(serversFile, []byte(servers), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	return &server.Balancer{ServerManager: serverManager, ReverseProxy: true}, unblock
+}
+
+// concurrency returns the requests in flight to node 1, and its concurrency limit
+func concurrency(t *testing.T, balancer *server.Balancer) (int, int) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	balancer.HandleStats(recorder, httptest.NewRequest(http.MethodGet, "/stats?node=1", nil))
+	var stats server.Stats
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil || len(stats.Nodes) != 1 {
+		t.Fatalf("invalid stats (%v): %s", err, recorder.Body.String())
+	}
+	return stats.Nodes[0].InFlight, stats.Nodes[0].ConcurrencyLimit
+}
+
+// startRequest proxies a request in the background, and waits until it reached the node. The returned channel is closed once it has been served
+func startRequest(t *testing.T, ctx context.Context, balancer *server.Balancer) <-chan struct{} {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`)).WithContext(ctx)
+		balancer.HandleRequest(httptest.NewRecorder(), request)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if inFlight, _ := concurrency(t, balancer); inFlight == 1 {
+			return done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrencyReleasedAfterRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// Whether the outcome lowers the concurrency limit of the node
+		lowered bool
+	}{
+		{"success", http.StatusOK, false},
+		{"server error", http.StatusBadGateway, true},
+		{"rate limited", http.StatusTooManyRequests, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			balancer, unblock := slowNodeBalancer(t, test.status)
+			_, initialLimit := concurrency(t, balancer)
+
+			done := startRequest(t, context.Background(), balancer)
+			close(unblock)
+			<-done
+
+			inFlight, limit := concurrency(t, balancer)
+			if inFlight != 0 {
+				t.Errorf("%d requests in flight, want the slot released", inFlight)
+			}
+			if lowered := limit < initialLimit; lowered != test.lowered {
+				t.Errorf("concurrency limit %d (initially %d), want lowered: %v", limit, initialLimit, test.lowered)
+			}
+		})
+	}
+}
+
+func TestConcurrencyReleasedWhenClientCancels(t *testing.T) {
+	balancer, _ := slowNodeBalancer(t, http.StatusOK)
+	_, initialLimit := concurrency(t, balancer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startRequest(t, ctx, balancer)
+	cancel()
+	<-done
+
+	// The slot is freed without blaming the node
+	inFlight, limit := concurrency(t, balancer)
+	if inFlight != 0 {
+		t.Errorf("%d requests in flight, want the slot released", inFlight)
+	}
+	if limit != initialLimit {
+		t.Errorf("concurrency limit %d, want it unchanged (%d)", limit, initialLimit)
+	}
+}
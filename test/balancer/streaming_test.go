@@ -0,0 +1,83 @@
+package balancer
+
+// Tests of the responses streamed by the nodes: they reach the client as they come, through the access log recorder
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+func TestStreamedResponseIsFlushed(t *testing.T) {
+	// The node sends the first line of its response, and the rest once the client received it
+	received := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("second\n"))
+	}))
+	t.Cleanup(node.Close)
+
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(serversFile, []byte(`{"servers":[{"id":1,"url":"`+node.URL+`","rate_limit":100,"burst_limit":100}]}`), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+	balancer := httptest.NewServer(http.HandlerFunc((&server.Balancer{ServerManager: serverManager, ReverseProxy: true}).HandleRequest))
+	t.Cleanup(balancer.Close)
+
+	// The first line arrives while the node still holds the rest of the response
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		resp, err := http.Post(balancer.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`))
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Fatalf("first line = %q, want %q", line, "first\n")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first line not received before the end of the response")
+	}
+	close(received)
+
+	if line := <-lines; line != "second\n" {
+		t.Errorf("second line = %q, want %q", line, "second\n")
+	}
+}
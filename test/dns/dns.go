@@ -0,0 +1,112 @@
+package main
+
+// Stub DNS server to test the discovery of the servers from DNS records (SERVER_STORE=dns, DNS_SERVER=127.0.0.1:5353)
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type srvRecord struct {
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5353", "Address to listen on (UDP)")
+	name := flag.String("name", "_rpc._tcp.balancer.local.", "Name of the SRV records")
+	srvFlag := flag.String("srv", "0:10:8080:localhost.,0:20:8081:localhost.", "SRV records, as priority:weight:port:target separated by commas")
+	aName := flag.String("a-name", "rpc.balancer.local.", "Name of the A records")
+	aFlag := flag.String("a", "127.0.0.1", "A records (IPv4) separated by commas")
+
+	flag.Parse()
+
+	var srvs []srvRecord
+	for _, entry := range strings.Split(*srvFlag, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 {
+			log.Fatalf("Invalid SRV record: %s. Must be priority:weight:port:target", entry)
+		}
+
+		values := make([]uint16, 3)
+		for i := range values {
+			value, err := strconv.ParseUint(parts[i], 10, 16)
+			if err != nil {
+				log.Fatalf("Invalid SRV record: %s: %v", entry, err)
+			}
+			values[i] = uint16(value)
+		}
+
+		srvs = append(srvs, srvRecord{priority: values[0], weight: values[1], port: values[2], target: parts[3]})
+	}
+
+	conn, err := net.ListenPacket("udp", *addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	log.Printf("Stub DNS server listening on %s (SRV %s, A %s)\n", *addr, *name, *aName)
+
+	buf := make([]byte, 512)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Failed to read query: %v\n", err)
+			continue
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		question, err := parser.Question()
+		if err != nil {
+			continue
+		}
+
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+		builder.EnableCompression()
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 5}
+
+		switch {
+		case question.Type == dnsmessage.TypeSRV && strings.EqualFold(question.Name.String(), *name):
+			for _, srv := range srvs {
+				builder.SRVResource(resource, dnsmessage.SRVResource{
+					Priority: srv.priority,
+					Weight:   srv.weight,
+					Port:     srv.port,
+					Target:   dnsmessage.MustNewName(srv.target),
+				})
+			}
+		case question.Type == dnsmessage.TypeA && strings.EqualFold(question.Name.String(), *aName):
+			for _, ipStr := range strings.Split(*aFlag, ",") {
+				ip := net.ParseIP(strings.TrimSpace(ipStr)).To4()
+				if ip == nil {
+					continue
+				}
+				builder.AResource(resource, dnsmessage.AResource{A: [4]byte(ip)})
+			}
+		}
+
+		response, err := builder.Finish()
+		if err != nil {
+			log.Printf("Failed to build response: %v\n", err)
+			continue
+		}
+
+		log.Printf("%s %s\n", question.Type, question.Name)
+		conn.WriteTo(response, client)
+	}
+}
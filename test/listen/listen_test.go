@@ -0,0 +1,190 @@
+package listen
+
+// Tests of the TLS termination: HTTP/2 negotiated with ALPN, and the certificate reloaded without a restart
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// writeCertificate generates a self-signed certificate for localhost and writes it and its key (PEM) to the files
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return certificate
+}
+
+// servedCommonName returns the common name of the certificate served on a new connection
+func servedCommonName(t *testing.T, addr string) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// serve starts the HTTP server of the load balancer with TLS, and returns its address and certificate reloader
+func serve(t *testing.T, config server.ListenConfig) (string, *server.CertificateReloader) {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	srv, certificates, err := server.NewHTTPServer(config, handler)
+	if err != nil {
+		t.Fatalf("failed to create HTTP server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go srv.ServeTLS(listener, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String(), certificates
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certificate := writeCertificate(t, certFile, keyFile, "first")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+
+	for _, http2 := range []bool{true, false} {
+		addr, _ := serve(t, server.ListenConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, HTTP2: http2})
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		want := "HTTP/1.1"
+		if http2 {
+			want = "HTTP/2.0"
+		}
+		if resp.StatusCode != http.StatusOK || resp.Proto != want {
+			t.Errorf("HTTP2=%v: got %d over %s, want 200 over %s", http2, resp.StatusCode, resp.Proto, want)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	addr, certificates := serve(t, server.ListenConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, HTTP2: true})
+	if name := servedCommonName(t, addr); name != "first" {
+		t.Fatalf("served certificate %q, want first", name)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		writeCertificate(t, certFile, keyFile, "second")
+		if err := certificates.Load(); err != nil {
+			t.Fatalf("failed to reload: %v", err)
+		}
+		if name := servedCommonName(t, addr); name != "second" {
+			t.Errorf("served certificate %q after reload, want second", name)
+		}
+
+		// An invalid file keeps the previous certificate
+		if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+			t.Fatalf("failed to write key: %v", err)
+		}
+		if err := certificates.Load(); err == nil {
+			t.Errorf("reloading an invalid key must fail")
+		}
+		if name := servedCommonName(t, addr); name != "second" {
+			t.Errorf("served certificate %q after a failed reload, want second", name)
+		}
+	})
+
+	t.Run("SIGHUP", func(t *testing.T) {
+		// Also catch SIGHUP here, so that a signal sent before the reloader listens does not stop the test
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go certificates.ReloadOnSIGHUP(stop)
+
+		writeCertificate(t, certFile, keyFile, "third")
+
+		deadline := time.Now().Add(5 * time.Second)
+		for servedCommonName(t, addr) != "third" {
+			if time.Now().After(deadline) {
+				t.Fatalf("certificate not reloaded on SIGHUP")
+			}
+			if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatalf("failed to send SIGHUP: %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
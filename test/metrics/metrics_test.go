@@ -0,0 +1,102 @@
+package metrics
+
+// Tests of the per-node metrics: reported from the state of the servers, and deleted with the servers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"load-balancer/src/server"
+)
+
+// URLs of the servers, no request is sent to them
+const (
+	healthyURL   = "http://healthy.test"
+	unhealthyURL = "http://unhealthy.test"
+)
+
+// nodeGauges returns the value of the gauges of a node, by metric name
+func nodeGauges(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	families, err := prom.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	gauges := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node" && label.GetValue() == url && metric.GetGauge() != nil {
+					gauges[family.GetName()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return gauges
+}
+
+func TestNodeMetrics(t *testing.T) {
+	servers := map[string]any{
+		"servers": []map[string]any{
+			{"id": 1, "url": healthyURL, "rate_limit": 10, "burst_limit": 5, "health_state": "healthy"},
+			{"id": 2, "url": unhealthyURL, "rate_limit": 10, "burst_limit": 5, "health_state": "unhealthy"},
+		},
+	}
+	data, err := json.Marshal(servers)
+	if err != nil {
+		t.Fatalf("failed to marshal servers: %v", err)
+	}
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(serversFile, data, 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+	balancer := &server.Balancer{ServerManager: serverManager}
+
+	// The health of every server is reported, including the ones out of rotation
+	for url, want := range map[string]map[string]float64{
+		healthyURL:   {"node_up": 1, "health_check_up": 1},
+		unhealthyURL: {"node_up": 0, "health_check_up": 0},
+	} {
+		gauges := nodeGauges(t, url)
+		for name, value := range want {
+			if got, ok := gauges[name]; !ok || got != value {
+				t.Errorf("%s{node=%q} = %v (reported: %v), want %v", name, url, got, ok, value)
+			}
+		}
+	}
+
+	// The series of a deleted server are deleted, it must not be reported down forever
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /admin/servers/{id}", balancer.HandleDeleteServer)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/admin/servers/2", nil))
+	if recorder.Code >= 300 {
+		t.Fatalf("failed to delete the server: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if gauges := nodeGauges(t, unhealthyURL); len(gauges) != 0 {
+		t.Errorf("deleted server still reported: %v", gauges)
+	}
+	if gauges := nodeGauges(t, healthyURL); gauges["node_up"] != 1 {
+		t.Errorf("remaining server not reported up: %v", gauges)
+	}
+}
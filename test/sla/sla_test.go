@@ -0,0 +1,207 @@
+package sla
+
+// Tests of the SLA report: the windows count the persisted days that began inside them, and the rollups of the replicas are summed after a restart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// rollupStore keeps the servers and the SLA rollups in memory, replacing the rollups of the same server, day and replica as the database does
+type rollupStore struct {
+	// The methods the tests don't need panic
+	server.ServerStore
+
+	servers []*server.RPCServer
+	mutex   sync.Mutex
+	rollups map[string]*server.SLARollup
+}
+
+func newRollupStore(servers ...*server.RPCServer) *rollupStore {
+	return &rollupStore{servers: servers, rollups: make(map[string]*server.SLARollup)}
+}
+
+func (s *rollupStore) GetActiveServers(ctx context.Context) ([]*server.RPCServer, error) {
+	return s.GetServers(ctx)
+}
+
+func (s *rollupStore) GetServersToCheck(ctx context.Context) ([]*server.RPCServer, error) {
+	return nil, nil
+}
+
+func (s *rollupStore) GetServers(ctx context.Context) ([]*server.RPCServer, error) {
+	var servers []*server.RPCServer
+	for _, rpcServer := range s.servers {
+		copied := *rpcServer
+		servers = append(servers, &copied)
+	}
+	return servers, nil
+}
+
+func (s *rollupStore) SetServerHealth(ctx context.Context, id int, state server.HealthState, reason string) error {
+	return nil
+}
+
+func (s *rollupStore) AddServerEvent(ctx context.Context, event *server.ServerEvent) error {
+	return nil
+}
+
+func (s *rollupStore) SaveSLARollups(ctx context.Context, rollups []*server.SLARollup) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, rollup := range rollups {
+		s.rollups[fmt.Sprintf("%d/%s/%s", rollup.ServerID, rollup.Day.Format(time.DateOnly), rollup.Replica)] = rollup
+	}
+	return nil
+}
+
+func (s *rollupStore) GetSLARollups(ctx context.Context, since time.Time) ([]*server.SLARollup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var rollups []*server.SLARollup
+	for _, rollup := range s.rollups {
+		rollups = append(rollups, rollup)
+	}
+	return rollups, nil
+}
+
+func (s *rollupStore) Watch(ctx context.Context, onChange func()) {
+	<-ctx.Done()
+}
+
+func (s *rollupStore) Close() error {
+	return nil
+}
+
+// newBalancer creates a balancer on the store, closed at the end of the test
+func newBalancer(t *testing.T, store *rollupStore) *server.Balancer {
+	t.Helper()
+
+	serverManager, err := server.NewServerManager(server.Config{
+		ServerStore:      store,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	return &server.Balancer{ServerManager: serverManager, ReverseProxy: true}
+}
+
+// serve sends requests to the balancer
+func serve(t *testing.T, balancer *server.Balancer, requests int) {
+	t.Helper()
+
+	for i := 0; i < requests; i++ {
+		recorder := httptest.NewRecorder()
+		balancer.HandleRequest(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+// windowRequests returns the requests of node 1 in each window of the SLA report
+func windowRequests(t *testing.T, balancer *server.Balancer) map[string]int64 {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	balancer.HandleSLAReport(recorder, httptest.NewRequest(http.MethodGet, "/admin/sla", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var report server.SLAReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid SLA report: %v", err)
+	}
+	if len(report.Nodes) != 1 {
+		t.Fatalf("SLA report has %d nodes, want 1", len(report.Nodes))
+	}
+
+	requests := make(map[string]int64)
+	for name, window := range report.Nodes[0].Windows {
+		requests[name] = window.Requests
+	}
+	return requests
+}
+
+func newNode(t *testing.T) *server.RPCServer {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1}`))
+	}))
+	t.Cleanup(node.Close)
+
+	return &server.RPCServer{ID: 1, URL: node.URL, RateLimit: 1000, BurstLimit: 1000, AdminState: server.AdminEnabled, HealthState: server.HealthHealthy, IsActive: true}
+}
+
+func TestSLAWindows(t *testing.T) {
+	store := newRollupStore(newNode(t))
+
+	// Days saved by another replica: today, 2 days ago, and 31 days ago (before the 30 days window)
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	for _, saved := range []struct {
+		day      time.Time
+		requests int64
+	}{{today, 100}, {today.AddDate(0, 0, -2), 20}, {today.AddDate(0, 0, -31), 3}} {
+		latency := make([]int64, len(server.SLA_LATENCY_BUCKETS)+1)
+		latency[0] = saved.requests
+		store.SaveSLARollups(context.Background(), []*server.SLARollup{
+			{ServerID: 1, Day: saved.day, Replica: "other", Requests: saved.requests, Latency: latency},
+		})
+	}
+
+	balancer := newBalancer(t, store)
+	serve(t, balancer, 5)
+
+	// A saved day is only counted by the windows it began in: today began in the last hour only just after midnight
+	want := map[string]int64{"1h": 5, "24h": 105, "30d": 125}
+	if now.Sub(today) < time.Hour {
+		want["1h"] = 105
+	}
+	if got := windowRequests(t, balancer); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("requests per window = %v, want %v", got, want)
+	}
+}
+
+func TestSLASurvivesRestartOfReplicas(t *testing.T) {
+	node := newNode(t)
+	store := newRollupStore(node)
+
+	// Two replicas serve requests at the same time, the last one saving its rollups doesn't replace the ones of the other
+	first := newBalancer(t, store)
+	second := newBalancer(t, store)
+	serve(t, first, 3)
+	serve(t, second, 2)
+	first.ServerManager.Close()
+	second.ServerManager.Close()
+
+	if rollups, _ := store.GetSLARollups(context.Background(), time.Time{}); len(rollups) != 2 {
+		t.Fatalf("store has %d rollups, want one per replica (2)", len(rollups))
+	}
+
+	// Restarted, the balancer reports the requests of both replicas in the windows of a day, and adds its own
+	restarted := newBalancer(t, store)
+	if got := windowRequests(t, restarted); got["24h"] != 5 || got["30d"] != 5 {
+		t.Errorf("requests per window after restart = %v, want 5 in 24h and 30d", got)
+	}
+
+	serve(t, restarted, 4)
+	if got := windowRequests(t, restarted); got["1h"] < 4 || got["24h"] != 9 || got["30d"] != 9 {
+		t.Errorf("requests per window = %v, want 9 in 24h and 30d", got)
+	}
+}
@@ -0,0 +1,98 @@
+package stats
+
+// Tests of the stats endpoint: every server is reported, including the ones out of rotation with their last health check
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"load-balancer/src/server"
+)
+
+// Health checks every second, instead of the hours of config.json
+const healthConfig = `{"healthCheck": {"interval": {"unit": "second", "value": 1}, "request": {"method": "POST", "body": {"jsonrpc": "2.0", "id": 1, "method": "getHealth"}}}}`
+
+func TestStatsReportUnhealthyNode(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(healthy.Close)
+	// Nothing listens on the port of a closed server, its health checks fail
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unhealthy.Close()
+
+	dir := t.TempDir()
+	servers := `{"servers":[
+		{"id":1,"url":"` + healthy.URL + `","rate_limit":10,"burst_limit":5,"health_state":"healthy"},
+		{"id":2,"url":"` + unhealthy.URL + `","rate_limit":10,"burst_limit":5,"health_state":"unhealthy"}]}`
+	serversFile := filepath.Join(dir, "servers.json")
+	healthConfigFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(serversFile, []byte(servers), 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+	if err := os.WriteFile(healthConfigFile, []byte(healthConfig), 0600); err != nil {
+		t.Fatalf("failed to write health config file: %v", err)
+	}
+
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: healthConfigFile,
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+	balancer := &server.Balancer{ServerManager: serverManager}
+
+	stats := func(query string) (int, server.Stats) {
+		recorder := httptest.NewRecorder()
+		balancer.HandleStats(recorder, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+		var stats server.Stats
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+				t.Fatalf("invalid stats: %v", err)
+			}
+		}
+		return recorder.Code, stats
+	}
+
+	if _, all := stats(""); len(all.Nodes) != 2 || all.ActiveNodes != 1 {
+		t.Fatalf("stats report %d nodes (%d active), want 2 (1 active)", len(all.Nodes), all.ActiveNodes)
+	}
+
+	// The unhealthy server is reported on its own, with the result of its health check once probed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, single := stats("?node=2")
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, want 200", status)
+		}
+		if len(single.Nodes) != 1 {
+			t.Fatalf("stats report %d nodes, want 1", len(single.Nodes))
+		}
+
+		node := single.Nodes[0]
+		if node.State != "inactive" || node.HealthState != server.HealthUnhealthy {
+			t.Errorf("node 2 state = %s, health = %s, want inactive and unhealthy", node.State, node.HealthState)
+		}
+		if check := node.LastHealthCheck; check != nil {
+			if check.Healthy || check.Error == "" {
+				t.Errorf("last health check = %+v, want a failure", check)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no health check reported for the unhealthy node")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if status, _ := stats("?node=3"); status != http.StatusNotFound {
+		t.Errorf("unknown node status = %d, want 404", status)
+	}
+}
@@ -0,0 +1,154 @@
+package tracing
+
+// Tests of the spans of a proxied request: a span per request, a child span per attempt, and the trace context propagated to the nodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"load-balancer/src/server"
+)
+
+// newBalancer creates a proxy balancer over the given nodes, stored in a servers file
+func newBalancer(t *testing.T, urls ...string) *server.Balancer {
+	t.Helper()
+
+	var servers []map[string]any
+	for i, url := range urls {
+		servers = append(servers, map[string]any{"id": i + 1, "url": url, "rate_limit": 100, "burst_limit": 100})
+	}
+	data, err := json.Marshal(map[string]any{"servers": servers})
+	if err != nil {
+		t.Fatalf("failed to marshal servers: %v", err)
+	}
+	serversFile := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(serversFile, data, 0600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	serverManager, err := server.NewServerManager(server.Config{
+		Store:            "file",
+		ServersFile:      serversFile,
+		HealthConfigFile: "../../config.json",
+		Transport:        server.DefaultTransportConfig(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server manager: %v", err)
+	}
+	t.Cleanup(func() { serverManager.Close() })
+
+	return &server.Balancer{ServerManager: serverManager, ReverseProxy: true}
+}
+
+// attributes returns the attributes of a span by key
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	values := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		values[kv.Key] = kv.Value
+	}
+	return values
+}
+
+func TestRequestSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	// Without an endpoint, only the propagation of the trace context is set up
+	if _, err := server.SetupTracing(context.Background(), server.TracingConfig{}); err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	// The first node called rate limits the request, which is retried on the other one
+	var calls atomic.Int32
+	var mutex sync.Mutex
+	traceparents := make(map[string]string)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		traceparents["http://"+r.Host] = r.Header.Get("traceparent")
+		mutex.Unlock()
+
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":1}`)
+	}
+	first := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(first.Close)
+	second := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(second.Close)
+
+	balancer := newBalancer(t, first.URL, second.URL)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`))
+	balancer.HandleRequest(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var requestSpan tracetest.SpanStub
+	var upstreamSpans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		switch span.Name {
+		case "HandleRequest":
+			requestSpan = span
+		case "upstream":
+			upstreamSpans = append(upstreamSpans, span)
+		}
+	}
+	if !requestSpan.SpanContext.IsValid() {
+		t.Fatalf("no HandleRequest span in %d spans", len(exporter.GetSpans()))
+	}
+	if method := attributes(requestSpan)["rpc.method"].AsString(); method != "getSlot" {
+		t.Errorf("HandleRequest rpc.method = %q, want getSlot", method)
+	}
+	if len(upstreamSpans) != 2 {
+		t.Fatalf("%d upstream spans, want 2 (one per attempt)", len(upstreamSpans))
+	}
+
+	wantStatus := []int64{http.StatusTooManyRequests, http.StatusOK}
+	for i, span := range upstreamSpans {
+		if span.Parent.SpanID() != requestSpan.SpanContext.SpanID() {
+			t.Errorf("upstream span %d is not a child of the HandleRequest span", i)
+		}
+
+		values := attributes(span)
+		if index := values["retry.index"].AsInt64(); index != int64(i) {
+			t.Errorf("upstream span %d retry.index = %d, want %d", i, index, i)
+		}
+		if method := values["rpc.method"].AsString(); method != "getSlot" {
+			t.Errorf("upstream span %d rpc.method = %q, want getSlot", i, method)
+		}
+		if status := values["http.response.status_code"].AsInt64(); status != wantStatus[i] {
+			t.Errorf("upstream span %d http.response.status_code = %d, want %d", i, status, wantStatus[i])
+		}
+
+		// The node received the context of the attempt span
+		url := values["node.url"].AsString()
+		if url != first.URL && url != second.URL {
+			t.Errorf("upstream span %d node.url = %q, want one of the nodes", i, url)
+		}
+		want := fmt.Sprintf("00-%s-%s-01", span.SpanContext.TraceID(), span.SpanContext.SpanID())
+		if traceparents[url] != want {
+			t.Errorf("node %s received traceparent %q, want %q", url, traceparents[url], want)
+		}
+	}
+}